@@ -3,7 +3,6 @@ package daikin
 import (
 	"context"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
@@ -48,6 +47,64 @@ func (dv *DaikinValues) String() string {
 	return fmt.Sprintf("{%s}", strings.Join(parts, " "))
 }
 
+// SetTemp bounds, in °C, across all modes.
+const (
+	MinSetTemp = 10.0
+	MaxSetTemp = 32.0
+)
+
+// setTempBounds are the SetTemp bounds accepted in each mode.
+// Modes not listed here (dry, fan) don't use SetTemp.
+var setTempBounds = map[daikinac.Mode][2]float64{
+	daikinac.ModeAuto: {18, 30},
+	daikinac.ModeCool: {18, MaxSetTemp},
+	daikinac.ModeHeat: {MinSetTemp, 30},
+}
+
+// checkSetTemp checks that t is a valid SetTemp in the given mode.
+func checkSetTemp(mode daikinac.Mode, t float64) error {
+	bounds, ok := setTempBounds[mode]
+	if !ok {
+		return fmt.Errorf("setTemp can't be set in mode: %v", mode)
+	}
+	if !(t >= bounds[0] && t <= bounds[1]) {
+		return fmt.Errorf("setTemp must be within %v-%v°C in mode %v, was: %v", bounds[0], bounds[1], mode, t)
+	}
+	return nil
+}
+
+// Validate checks that these values are valid to send to a device.
+// A SetTemp without a Mode can only be checked against MinSetTemp and MaxSetTemp here; Run checks it against the device's current mode before sending.
+func (dv *DaikinValues) Validate() error {
+	if dv.HomeTemp != nil || dv.OutsideTemp != nil {
+		return fmt.Errorf("homeTemp and outsideTemp are not settable")
+	}
+
+	if dv.Mode != nil {
+		switch *dv.Mode {
+		case daikinac.ModeAuto, daikinac.ModeDry, daikinac.ModeCool, daikinac.ModeHeat, daikinac.ModeFan:
+		default:
+			return fmt.Errorf("unknown mode: %v", *dv.Mode)
+		}
+	}
+
+	if dv.FanRate != nil && (*dv.FanRate < daikinac.FanAuto || *dv.FanRate > 7) {
+		return fmt.Errorf("fanRate must be 1 (auto), 2 (quiet) or 3-7, was: %v", *dv.FanRate)
+	}
+
+	if dv.SetTemp != nil {
+		t := *dv.SetTemp
+		if dv.Mode != nil {
+			return checkSetTemp(*dv.Mode, t)
+		}
+		if !(t >= MinSetTemp && t <= MaxSetTemp) {
+			return fmt.Errorf("setTemp must be within %v-%v°C, was: %v", MinSetTemp, MaxSetTemp, t)
+		}
+	}
+
+	return nil
+}
+
 func Run(ctx context.Context, device daikinac.Device, readSet func() (set *DaikinValues)) (v DaikinValues, err error) {
 	start := time.Now()
 
@@ -86,6 +143,11 @@ func Run(ctx context.Context, device daikinac.Device, readSet func() (set *Daiki
 			ci.FanRate = *s.FanRate
 		}
 		if s.SetTemp != nil {
+			// the set may not include a mode, so check against the mode the device will be in
+			err = checkSetTemp(ci.Mode, *s.SetTemp)
+			if err != nil {
+				return v, err
+			}
 			ci.SetTemp = *s.SetTemp
 		}
 
@@ -116,8 +178,7 @@ func Run(ctx context.Context, device daikinac.Device, readSet func() (set *Daiki
 		v.OutsideTemp = &si.OutsideTemp
 	}
 
-	hasUUID := device.UUID != ""
-	log.Printf("run AC uuid=%v (set=%s, read=%s) info took %v", hasUUID, s, &v, time.Since(start))
+	logger().DebugContext(ctx, "ran AC", "host", device.Host, "uuid", device.UUID != "", "set", s, "read", &v, "duration", time.Since(start))
 
 	return v, nil
 }
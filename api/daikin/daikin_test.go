@@ -0,0 +1,94 @@
+package daikin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/samthor/daikinac"
+)
+
+func TestValidate(t *testing.T) {
+	ptr := func(v float64) *float64 { return &v }
+	mode := func(m daikinac.Mode) *daikinac.Mode { return &m }
+	fan := func(f daikinac.FanRate) *daikinac.FanRate { return &f }
+
+	tests := []struct {
+		name    string
+		dv      DaikinValues
+		wantErr bool
+	}{
+		{"empty", DaikinValues{}, false},
+		{"mode", DaikinValues{Mode: mode(daikinac.ModeCool)}, false},
+		{"unknown mode", DaikinValues{Mode: mode(5)}, true},
+		{"fan auto", DaikinValues{FanRate: fan(daikinac.FanAuto)}, false},
+		{"fan 7", DaikinValues{FanRate: fan(7)}, false},
+		{"fan 8", DaikinValues{FanRate: fan(8)}, true},
+		{"fan 0", DaikinValues{FanRate: fan(0)}, true},
+		{"setTemp without mode", DaikinValues{SetTemp: ptr(12)}, false}, // checked against the current mode by Run
+		{"setTemp without mode too low", DaikinValues{SetTemp: ptr(9.5)}, true},
+		{"setTemp without mode too high", DaikinValues{SetTemp: ptr(32.5)}, true},
+		{"cool", DaikinValues{Mode: mode(daikinac.ModeCool), SetTemp: ptr(18)}, false},
+		{"cool too low", DaikinValues{Mode: mode(daikinac.ModeCool), SetTemp: ptr(12)}, true},
+		{"heat", DaikinValues{Mode: mode(daikinac.ModeHeat), SetTemp: ptr(12)}, false},
+		{"heat too high", DaikinValues{Mode: mode(daikinac.ModeHeat), SetTemp: ptr(31)}, true},
+		{"auto", DaikinValues{Mode: mode(daikinac.ModeAuto), SetTemp: ptr(30)}, false},
+		{"setTemp in fan mode", DaikinValues{Mode: mode(daikinac.ModeFan), SetTemp: ptr(20)}, true},
+		{"homeTemp", DaikinValues{HomeTemp: ptr(20)}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.dv.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got err=%v, want error=%v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRunSetTempMode(t *testing.T) {
+	var sets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/aircon/get_control_info":
+			w.Write([]byte("ret=OK,pow=1,mode=3,stemp=22.0,shum=0,f_rate=A,f_dir=0"))
+		case "/aircon/get_sensor_info":
+			w.Write([]byte("ret=OK,htemp=21.0,otemp=15.0"))
+		case "/aircon/set_control_info":
+			sets = append(sets, r.URL.Query().Get("mode")+"/"+r.URL.Query().Get("stemp"))
+			w.Write([]byte("ret=OK"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	device := daikinac.Device{Host: strings.TrimPrefix(srv.URL, "http://")}
+
+	ptr := func(v float64) *float64 { return &v }
+	heat := daikinac.ModeHeat
+
+	tests := []struct {
+		name    string
+		set     *DaikinValues
+		wantErr bool
+		wantSet string // empty if nothing sent
+	}{
+		{"get", nil, false, ""},
+		{"within cool", &DaikinValues{SetTemp: ptr(20)}, false, "3/20.0"},
+		{"too low for cool", &DaikinValues{SetTemp: ptr(12)}, true, ""},
+		{"heat", &DaikinValues{Mode: &heat, SetTemp: ptr(12)}, false, "4/12.0"},
+	}
+
+	for _, tt := range tests {
+		sets = nil
+		_, err := Run(context.Background(), device, func() *DaikinValues { return tt.set })
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got err=%v, want error=%v", tt.name, err, tt.wantErr)
+		}
+		got := strings.Join(sets, ",")
+		if got != tt.wantSet {
+			t.Errorf("%s: got sent %q, want %q", tt.name, got, tt.wantSet)
+		}
+	}
+}
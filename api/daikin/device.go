@@ -7,8 +7,8 @@ import (
 )
 
 type Device struct {
-	Host string
-	UUID string
+	Host string `json:"host"`
+	UUID string `json:"uuid,omitempty"`
 }
 
 func (d *Device) Run(ctx context.Context, readSet func() (set *DaikinValues)) (v DaikinValues, err error) {
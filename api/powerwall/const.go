@@ -3,7 +3,6 @@ package powerwall
 import (
 	"context"
 	"encoding/json"
-	"log"
 )
 
 // these are the three queries from pypowerwall (from some kind of extraction from firmware)
@@ -122,7 +121,7 @@ func GetStatus(ctx context.Context, td *TEDApi) (err error) {
 	}
 
 	nice, _ := json.MarshalIndent(out, "", "  ")
-	log.Printf("status=\n%s\n", nice)
+	logger().InfoContext(ctx, "got status", "status", string(nice))
 
 	return err
 }
@@ -133,6 +132,6 @@ func GetConfig(ctx context.Context, td *TEDApi) (err error) {
 		return err
 	}
 
-	log.Printf("config=\n%s\n", out)
+	logger().InfoContext(ctx, "got config", "config", string(out))
 	return nil
 }
@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"sync"
 
@@ -164,7 +163,7 @@ func (td *TEDApi) getDIN(ctx context.Context) (din string, err error) {
 	}
 
 	td.internalDIN = string(body)
-	log.Printf("got DIN from leader: %v", td.internalDIN)
+	logger().InfoContext(ctx, "got DIN from leader", "din", td.internalDIN)
 	return td.internalDIN, nil
 }
 
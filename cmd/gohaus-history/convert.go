@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/samthor/gohaus/history"
+)
+
+func runConvert(args []string) {
+	fs := newFlagSet("convert", "<history dir or file>...")
+	to := fs.String("to", string(history.FormatBinary), "format to convert to: jsonl or bin")
+	keep := fs.Bool("keep", false, "keep the original files (reads will see packets twice)")
+	fs.Parse(args)
+
+	format, err := history.ParseFormat(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	paths, err := expandPaths(fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	for _, path := range paths {
+		from, _ := history.FileFormat(path)
+		day, isDay := history.FileDay(path)
+
+		if history.IsUnmigrated(path) {
+			log.Printf("skipping %s, which must first be migrated by running gohaus with it", path)
+			continue
+		} else if isDay && day >= today {
+			log.Printf("skipping %s, which may still be written to", path)
+			continue
+		} else if from == format && !history.IsLegacy(path) {
+			continue // already converted; legacy files are always split into days
+		}
+
+		outputs, err := history.Convert(path, format)
+		if err != nil {
+			log.Fatalf("could not convert %s: %v", path, err)
+		}
+		log.Printf("converted %s => %v", path, outputs)
+
+		if !*keep {
+			err = os.Remove(path)
+			if err != nil {
+				log.Fatalf("could not remove %s: %v", path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samthor/gohaus/history"
+)
+
+func runExport(args []string) {
+	fs := newFlagSet("export", "<history dir or file>...")
+	format := fs.String("format", "line", "format to export: line for InfluxDB line protocol, or csv")
+	parseRange := rangeFlags(fs, "export")
+	measurement := fs.String("measurement", "gohaus", "measurement name for line protocol")
+	output := fs.String("o", "", "file to write to, default stdout")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	} else if *format != "line" && *format != "csv" {
+		log.Fatalf("unknown format %q, must be line or csv", *format)
+	}
+
+	r := parseRange()
+	paths, err := expandPaths(fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths = r.files(paths)
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	bw := bufio.NewWriter(out)
+
+	if *format == "line" {
+		var b []byte
+		err = r.each(paths, func(p history.Packet) error {
+			b = history.AppendLine(b[:0], *measurement, p)
+			_, err := bw.Write(b)
+			return err
+		})
+	} else {
+		err = exportCSV(bw, r, paths)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// exportCSV writes a row per packet in time order, with a column per key.
+// Unlike line protocol, rows must be sorted and all keys known first, so this reads everything before writing.
+func exportCSV(w io.Writer, r exportRange, paths []string) error {
+	all := map[string]bool{}
+	var packets []history.Packet
+	err := r.each(paths, func(p history.Packet) error {
+		for key := range p.Packet {
+			all[key] = true
+		}
+		packets = append(packets, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	keys := slices.Sorted(maps.Keys(all))
+	slices.SortStableFunc(packets, func(a, b history.Packet) int {
+		return cmp.Compare(a.When, b.When)
+	})
+
+	cw := csv.NewWriter(w)
+	err = cw.Write(append([]string{"time", "topic"}, keys...))
+	if err != nil {
+		return err
+	}
+
+	row := make([]string, len(keys)+2)
+	for _, p := range packets {
+		row[0] = time.Unix(p.When, 0).UTC().Format(time.RFC3339)
+		row[1] = p.Topic
+		for i, key := range keys {
+			row[i+2] = formatValue(p.Packet[key])
+		}
+		err = cw.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// exportRange selects packets by topic and time.
+type exportRange struct {
+	filters  []string
+	from, to time.Time // zero for unbounded
+}
+
+// rangeFlags adds flags to select packets to fs, returning a func to parse them after fs is parsed.
+func rangeFlags(fs *flag.FlagSet, verb string) (parse func() exportRange) {
+	topics := fs.String("topic", "#", fmt.Sprintf("comma-separated MQTT topic filters to %s", verb))
+	from := fs.String("from", "", fmt.Sprintf("%s from this time, RFC 3339 or unix seconds", verb))
+	to := fs.String("to", "", fmt.Sprintf("%s until this time (exclusive), RFC 3339 or unix seconds", verb))
+
+	return func() (r exportRange) {
+		var err error
+		r.filters = strings.Split(*topics, ",")
+		for _, filter := range r.filters {
+			if !history.ValidTopicFilter(filter) {
+				log.Fatalf("bad topic filter %q", filter)
+			}
+		}
+		if *from != "" {
+			r.from, err = history.ParseTime(*from)
+			if err != nil {
+				log.Fatalf("bad -from: %v", err)
+			}
+		}
+		if *to != "" {
+			r.to, err = history.ParseTime(*to)
+			if err != nil {
+				log.Fatalf("bad -to: %v", err)
+			}
+		}
+		return r
+	}
+}
+
+func (r exportRange) matchTopic(topic string) bool {
+	return slices.ContainsFunc(r.filters, func(filter string) bool { return history.MatchTopic(filter, topic) })
+}
+
+// files returns the paths which may hold packets in range, based on their topic and day.
+func (r exportRange) files(paths []string) (out []string) {
+	for _, path := range paths {
+		topic, err := history.FileTopic(path)
+		if err != nil || !r.matchTopic(topic) {
+			continue
+		}
+
+		if day, ok := history.FileDay(path); ok {
+			if !r.from.IsZero() && day < r.from.UTC().Format("2006-01-02") {
+				continue
+			} else if !r.to.IsZero() && day > r.to.UTC().Format("2006-01-02") {
+				continue
+			}
+		}
+		out = append(out, path)
+	}
+	return out
+}
+
+// each calls fn for every packet in range in the given files, in file order.
+func (r exportRange) each(paths []string, fn func(p history.Packet) error) error {
+	for _, path := range paths {
+		hr, err := history.Open(path)
+		if err != nil {
+			return err
+		}
+
+		for {
+			p, err := hr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				hr.Close()
+				return fmt.Errorf("%s: %w", path, err)
+			}
+
+			if !r.from.IsZero() && p.When < r.from.Unix() {
+				continue
+			} else if !r.to.IsZero() && p.When >= r.to.Unix() {
+				continue
+			}
+			err = fn(p)
+			if err != nil {
+				hr.Close()
+				return err
+			}
+		}
+		hr.Close()
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Command gohaus-history works with history recorded by gohaus.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+
+	"github.com/samthor/gohaus/history"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string)
+}
+
+var commands = []command{
+	{"convert", "convert history files to another format", runConvert},
+	{"export", "export history as InfluxDB line protocol or CSV", runExport},
+	{"replay", "publish history back to MQTT, for testing", runReplay},
+}
+
+func main() {
+	log.SetFlags(0)
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+		for _, c := range commands {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %-10s %s\n", c.name, c.usage)
+		}
+	}
+	flag.Parse()
+
+	i := slices.IndexFunc(commands, func(c command) bool { return c.name == flag.Arg(0) })
+	if i == -1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	commands[i].run(flag.Args()[1:])
+}
+
+// newFlagSet returns a FlagSet for the named command, whose remaining args are described by argsUsage.
+func newFlagSet(name, argsUsage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n", os.Args[0], name, argsUsage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// expandPaths returns all history files in the given paths, each either a file or a history directory.
+func expandPaths(paths []string) (out []string, err error) {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			out = append(out, p)
+			continue
+		}
+		all, err := history.Files(p)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, all...)
+	}
+	return out, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"slices"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/samthor/gohaus/history"
+	"github.com/samthor/gohaus/mqttconn"
+)
+
+func runReplay(args []string) {
+	fs := newFlagSet("replay", "<history dir or file>...")
+	var mo mqttconn.Options
+	fs.StringVar(&mo.URL, "url", "mqtt://localhost:1883", "mqtt url to publish to, credentials also via $MQTT_USERNAME and $MQTT_PASSWORD")
+	fs.StringVar(&mo.CA, "ca", "", "path to PEM CA bundle for mqtts:// or wss://")
+	fs.StringVar(&mo.Cert, "cert", "", "path to PEM client certificate")
+	fs.StringVar(&mo.Key, "key", "", "path to PEM client key")
+	prefix := fs.String("prefix", "replay/", "prefix for published topics; empty to publish to the original topics")
+	speed := fs.Float64("speed", 1, "replay this many times faster than real time, or 0 for as fast as possible")
+	parseRange := rangeFlags(fs, "replay") // -from seeks
+	retain := fs.Bool("retain", false, "publish as retained messages")
+	verbose := fs.Bool("v", false, "log every packet published")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	} else if *speed < 0 {
+		log.Fatalf("bad -speed: can't be negative")
+	} else if (mo.Cert == "") != (mo.Key == "") {
+		log.Fatalf("-cert and -key must be set together")
+	}
+
+	r := parseRange()
+	paths, err := expandPaths(fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// topics are in separate files, so read everything to interleave them
+	var packets []history.Packet
+	err = r.each(r.files(paths), func(p history.Packet) error {
+		packets = append(packets, p)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	slices.SortStableFunc(packets, func(a, b history.Packet) int {
+		return cmp.Compare(a.When, b.When)
+	})
+	if len(packets) == 0 {
+		log.Printf("nothing to replay")
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cm, err := connect(ctx, mo)
+	if err != nil {
+		log.Fatalf("could not connect to %s: %v", mo.URL, err)
+	}
+	defer func() {
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		cm.Disconnect(disconnectCtx)
+	}()
+
+	first := packets[0].When
+	rate := fmt.Sprintf("%vx", *speed)
+	if *speed == 0 {
+		rate = "full speed"
+	}
+	log.Printf("replaying %d packets from %s at %s", len(packets), time.Unix(first, 0).UTC().Format(time.RFC3339), rate)
+
+	start := time.Now()
+	for i, p := range packets {
+		if *speed > 0 {
+			at := start.Add(time.Duration(float64(time.Duration(p.When-first)*time.Second) / *speed))
+			select {
+			case <-ctx.Done():
+				log.Printf("stopped after %d packets", i)
+				return
+			case <-time.After(time.Until(at)):
+			}
+		} else if ctx.Err() != nil {
+			log.Printf("stopped after %d packets", i)
+			return
+		}
+
+		payload, err := json.Marshal(history.Unflatten(p.Packet))
+		if err != nil {
+			log.Fatal(err)
+		}
+		topic := *prefix + p.Topic
+		_, err = cm.Publish(ctx, &paho.Publish{Topic: topic, Payload: payload, Retain: *retain})
+		if err != nil && ctx.Err() == nil {
+			log.Fatalf("could not publish to %s: %v", topic, err)
+		}
+		if *verbose {
+			log.Printf("%s %s %s", time.Unix(p.When, 0).UTC().Format(time.RFC3339), topic, payload)
+		}
+	}
+	log.Printf("replayed %d packets", len(packets))
+}
+
+// connect connects to the broker, waiting until connected.
+func connect(ctx context.Context, mo mqttconn.Options) (*autopaho.ConnectionManager, error) {
+	cfg, err := mo.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.KeepAlive = 10
+	cfg.OnConnectError = func(err error) {
+		log.Printf("could not connect: %v", err)
+	}
+	cfg.CleanStartOnInitialConnection = true
+	cfg.ClientConfig = paho.ClientConfig{
+		ClientID: fmt.Sprintf("gohaus-replay-%d", rand.Int32()),
+	}
+
+	cm, err := autopaho.NewConnection(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cm, cm.AwaitConnection(ctx)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/samthor/gohaus/api/daikin"
+	"github.com/samthor/gohaus/history"
+	"github.com/samthor/gohaus/mqttconn"
+)
+
+// Config describes a house: the MQTT broker, the devices to bridge, and the topics to record.
+// It is read from the JSON file passed via -config.
+type Config struct {
+	MQTT      MQTTConfig              `json:"mqtt"`
+	Daikin    map[string]DaikinConfig `json:"daikin"`    // keyed by ID, published as "virt/daikin-ac/<id>"
+	Powerwall *PowerwallConfig        `json:"powerwall"` // nil if no Powerwall, also enabled by -gw_pw
+	History   []HistoryConfig         `json:"history"`
+
+	DiscoveryPrefix string `json:"discoveryPrefix"` // if set, publish Home Assistant discovery, usually "homeassistant"
+
+	HTTP       string   `json:"http"`       // if set, address to serve HTTP on, e.g. ":8080"
+	StaleAfter Duration `json:"staleAfter"` // default for devices and history, falls back to -stale_after
+
+	HistoryFiles HistoryFilesConfig `json:"historyFiles"` // how history is stored under -history
+	LineSink     LineSinkConfig     `json:"lineSink"`     // where history is also sent as it arrives, if anywhere
+
+	Log LogConfig `json:"log"`
+}
+
+type MQTTConfig struct {
+	mqttconn.Options // credentials also fall back to -mqtt_user and -mqtt_pass
+
+	AvailabilityTopic string `json:"availabilityTopic"` // bridge "online"/"offline", default "virt/gohaus/availability"
+}
+
+func (mc *MQTTConfig) availabilityTopic() string {
+	if mc.AvailabilityTopic != "" {
+		return mc.AvailabilityTopic
+	}
+	return "virt/gohaus/availability"
+}
+
+// DeviceConfig configures how a virtual device is bridged, see DeviceOptions.
+type DeviceConfig struct {
+	Retain       bool     `json:"retain"`
+	OfflineAfter int      `json:"offlineAfter"`
+	PollEvery    Duration `json:"pollEvery"`
+	StaleAfter   Duration `json:"staleAfter"` // falls back to the top-level staleAfter
+}
+
+func (dc *DeviceConfig) options() *DeviceOptions {
+	return &DeviceOptions{
+		Retain:       dc.Retain,
+		OfflineAfter: dc.OfflineAfter,
+		PollEvery:    time.Duration(dc.PollEvery),
+		StaleAfter:   time.Duration(dc.StaleAfter),
+	}
+}
+
+func (dc *DeviceConfig) validate() error {
+	if dc.OfflineAfter < 0 {
+		return fmt.Errorf("offlineAfter can't be negative")
+	}
+	if dc.PollEvery < 0 {
+		return fmt.Errorf("pollEvery can't be negative")
+	}
+	if dc.StaleAfter < 0 {
+		return fmt.Errorf("staleAfter can't be negative")
+	}
+	return nil
+}
+
+type DaikinConfig struct {
+	daikin.Device
+	DeviceConfig
+}
+
+type PowerwallConfig struct {
+	Secret string `json:"secret"` // falls back to -gw_pw
+	Host   string `json:"host"`
+	DIN    string `json:"din"`
+	DeviceConfig
+}
+
+type HistoryConfig struct {
+	Topic       string   `json:"topic"`       // may contain MQTT wildcards, recording each matching topic separately
+	MinDuration Duration `json:"minDuration"` // falls back to -history_every
+	GetKey      string   `json:"getKey"`      // "-" to never send "/get"
+	StaleAfter  Duration `json:"staleAfter"`  // falls back to the top-level staleAfter
+
+	// Patterns of flattened keys like "update.state", see HistoryReq.
+	StringKeys []string `json:"stringKeys"`
+	Include    []string `json:"include"`
+	Exclude    []string `json:"exclude"`
+
+	// Deadband, by key pattern, records on change rather than every minDuration, see HistoryReq.
+	Deadband    map[string]Deadband `json:"deadband"`
+	MaxInterval Duration            `json:"maxInterval"` // with deadband, default 10*minDuration
+	MinSpacing  Duration            `json:"minSpacing"`  // with deadband, default minDuration/2
+}
+
+// key returns a comparable form of the config, as it isn't comparable itself.
+func (hc HistoryConfig) key() string {
+	b, _ := json.Marshal(hc)
+	return string(b)
+}
+
+type HistoryFilesConfig struct {
+	Format    string   `json:"format"`    // "jsonl" (default) or "bin", falls back to -history_format
+	Compress  string   `json:"compress"`  // "gzip" (default) or "none", applied to days once closed
+	MaxAge    Duration `json:"maxAge"`    // if set, remove days older than this
+	MaxBytes  int64    `json:"maxBytes"`  // if set, remove the oldest days while history is larger than this
+	SyncEvery Duration `json:"syncEvery"` // default 10s
+
+	// Packets are queued to be written, so a slow or failing disk doesn't stall recording.
+	QueueSize  int      `json:"queueSize"`  // default 10000
+	DropPolicy string   `json:"dropPolicy"` // when the queue is full, drop the "oldest" (default) or "newest" packet
+	LateAfter  Duration `json:"lateAfter"`  // packets written this long after arriving are counted as late, default 1m
+}
+
+func (hc *HistoryFilesConfig) options(dir string) history.WriterOptions {
+	format, _ := history.ParseFormat(hc.Format) // already validated
+	return history.WriterOptions{
+		Dir:       dir,
+		Format:    format,
+		Gzip:      hc.Compress != "none",
+		SyncEvery: time.Duration(hc.SyncEvery),
+		MaxAge:    time.Duration(hc.MaxAge),
+		MaxBytes:  hc.MaxBytes,
+	}
+}
+
+func (hc *HistoryFilesConfig) validate() error {
+	if _, err := history.ParseFormat(hc.Format); err != nil {
+		return fmt.Errorf("format: %w", err)
+	}
+	switch hc.Compress {
+	case "", "gzip", "none":
+	default:
+		return fmt.Errorf("compress: must be \"gzip\" or \"none\", was %q", hc.Compress)
+	}
+	if hc.MaxAge < 0 || hc.MaxBytes < 0 || hc.SyncEvery < 0 || hc.QueueSize < 0 || hc.LateAfter < 0 {
+		return fmt.Errorf("maxAge, maxBytes, syncEvery, queueSize and lateAfter can't be negative")
+	}
+	switch historyDropPolicy(hc.DropPolicy) {
+	case "", dropOldest, dropNewest:
+	default:
+		return fmt.Errorf("dropPolicy: must be %q or %q, was %q", dropOldest, dropNewest, hc.DropPolicy)
+	}
+	return nil
+}
+
+// LineSinkConfig sends history in InfluxDB line protocol as it arrives, to a file or over HTTP.
+type LineSinkConfig struct {
+	File        string `json:"file"`        // append to this file
+	URL         string `json:"url"`         // or POST to this URL, e.g. "http://influx:8086/api/v2/write?org=haus&bucket=gohaus"
+	Token       string `json:"token"`       // if set, sent as "Authorization: Token <token>"
+	Measurement string `json:"measurement"` // default "gohaus"
+}
+
+func (lc *LineSinkConfig) enabled() bool {
+	return lc.File != "" || lc.URL != ""
+}
+
+func (lc *LineSinkConfig) validate() error {
+	if lc.File != "" && lc.URL != "" {
+		return fmt.Errorf("only one of file or url can be set")
+	}
+	if lc.URL != "" {
+		u, err := url.Parse(lc.URL)
+		if err != nil {
+			return fmt.Errorf("url: %w", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("url: must be http or https, was %q", lc.URL)
+		}
+	}
+	return nil
+}
+
+// Duration is a time.Duration which is encoded in JSON as a string like "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// loadConfig reads and validates the config at the given path.
+// If path is empty, a config is built from flags alone.
+func loadConfig(path string) (c *Config, err error) {
+	c = &Config{}
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+
+	err = c.applyFlags()
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		if path == "" {
+			path = "(flags)"
+		}
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// applyFlags fills in values not specified in the config file from flags.
+// Flags explicitly passed on the command-line always win.
+func (c *Config) applyFlags() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if c.MQTT.URL == "" || set["url"] {
+		c.MQTT.URL = *flagURL
+	}
+	if *flagMQTTUser != "" {
+		c.MQTT.Username = *flagMQTTUser
+	}
+	if *flagMQTTPass != "" {
+		c.MQTT.Password = *flagMQTTPass
+	}
+	if *flagMQTTCA != "" {
+		c.MQTT.CA = *flagMQTTCA
+	}
+	if *flagMQTTCert != "" {
+		c.MQTT.Cert = *flagMQTTCert
+	}
+	if *flagMQTTKey != "" {
+		c.MQTT.Key = *flagMQTTKey
+	}
+
+	if c.HTTP == "" || set["http"] {
+		c.HTTP = *flagHTTP
+	}
+
+	if *flagTeslaSecret != "" {
+		if c.Powerwall == nil {
+			c.Powerwall = &PowerwallConfig{}
+		}
+		if c.Powerwall.Secret == "" || set["gw_pw"] {
+			c.Powerwall.Secret = *flagTeslaSecret
+		}
+	}
+
+	for i := range c.History {
+		if c.History[i].MinDuration == 0 {
+			c.History[i].MinDuration = Duration(*flagStandardHistory)
+		}
+	}
+
+	if c.HistoryFiles.Format == "" || set["history_format"] {
+		c.HistoryFiles.Format = *flagHistoryFormat
+	}
+
+	if c.StaleAfter == 0 || set["stale_after"] {
+		c.StaleAfter = Duration(*flagStaleAfter)
+	}
+	for id, device := range c.Daikin {
+		if device.StaleAfter == 0 {
+			device.StaleAfter = c.StaleAfter
+			c.Daikin[id] = device
+		}
+	}
+	if c.Powerwall != nil && c.Powerwall.StaleAfter == 0 {
+		c.Powerwall.StaleAfter = c.StaleAfter
+	}
+	for i := range c.History {
+		if c.History[i].StaleAfter == 0 {
+			c.History[i].StaleAfter = c.StaleAfter
+		}
+	}
+
+	if *flagLogJSON {
+		c.Log.JSON = true
+	}
+	if c.Log.Level == "" || set["log_level"] {
+		c.Log.Level = *flagLogLevel
+	}
+	if *flagLogLevels != "" {
+		levels, err := parseLogLevelsFlag(*flagLogLevels)
+		if err != nil {
+			return fmt.Errorf("-log_levels: %w", err)
+		}
+		if c.Log.Levels == nil {
+			c.Log.Levels = map[string]string{}
+		}
+		maps.Copy(c.Log.Levels, levels)
+	}
+	if *flagLogTopics != "" {
+		topics, err := parseLogLevelsFlag(*flagLogTopics)
+		if err != nil {
+			return fmt.Errorf("-log_topics: %w", err)
+		}
+		if c.Log.Topics == nil {
+			c.Log.Topics = map[string]string{}
+		}
+		maps.Copy(c.Log.Topics, topics)
+	}
+
+	return nil
+}
+
+func (c *Config) validate() error {
+	u, err := url.Parse(c.MQTT.URL)
+	if err != nil {
+		return fmt.Errorf("mqtt.url: %w", err)
+	} else if u.Host == "" {
+		return fmt.Errorf("mqtt.url: %q must be like \"mqtt://host:1883\"", u.Redacted())
+	}
+	switch u.Scheme {
+	case "mqtt", "tcp", "mqtts", "ssl", "tls", "ws", "wss":
+	default:
+		return fmt.Errorf("mqtt.url: unsupported scheme %q", u.Scheme)
+	}
+
+	if strings.ContainsAny(c.MQTT.AvailabilityTopic, "+#") {
+		return fmt.Errorf("mqtt.availabilityTopic: can't contain wildcards")
+	}
+	if (c.MQTT.Cert == "") != (c.MQTT.Key == "") {
+		return fmt.Errorf("mqtt: cert and key must be specified together")
+	}
+	if _, err := c.MQTT.TLSConfig(); err != nil {
+		return fmt.Errorf("mqtt: %w", err)
+	}
+
+	for id, device := range c.Daikin {
+		if id == "" || strings.ContainsAny(id, "/+#") {
+			return fmt.Errorf("daikin[%q]: ID must be non-empty and not contain '/', '+' or '#'", id)
+		}
+		if device.Host == "" {
+			return fmt.Errorf("daikin[%q]: missing host", id)
+		}
+		if err := device.DeviceConfig.validate(); err != nil {
+			return fmt.Errorf("daikin[%q]: %w", id, err)
+		}
+	}
+
+	if c.Powerwall != nil {
+		if c.Powerwall.Secret == "" {
+			return fmt.Errorf("powerwall: missing secret (set in config or via -gw_pw)")
+		}
+		if err := c.Powerwall.DeviceConfig.validate(); err != nil {
+			return fmt.Errorf("powerwall: %w", err)
+		}
+	}
+
+	if c.StaleAfter < 0 {
+		return fmt.Errorf("staleAfter can't be negative")
+	}
+
+	if _, err := c.Log.parseLevels(); err != nil {
+		return fmt.Errorf("log.%w", err)
+	}
+	if _, err := c.Log.parseTopics(); err != nil {
+		return fmt.Errorf("log.%w", err)
+	}
+
+	if strings.ContainsAny(c.DiscoveryPrefix, "+#") {
+		return fmt.Errorf("discoveryPrefix: can't contain wildcards")
+	}
+
+	if err := c.HistoryFiles.validate(); err != nil {
+		return fmt.Errorf("historyFiles.%w", err)
+	}
+	if err := c.LineSink.validate(); err != nil {
+		return fmt.Errorf("lineSink: %w", err)
+	}
+
+	seen := map[string]int{}
+	for i, h := range c.History {
+		if h.Topic == "" {
+			return fmt.Errorf("history[%d]: missing topic", i)
+		}
+		if !history.ValidTopicFilter(h.Topic) {
+			return fmt.Errorf("history[%d] topic=%q: wildcards must be a whole level, and '#' must be last", i, h.Topic)
+		}
+		if h.MinDuration <= 0 {
+			return fmt.Errorf("history[%d] topic=%q: minDuration must be positive", i, h.Topic)
+		}
+		if h.StaleAfter < 0 {
+			return fmt.Errorf("history[%d] topic=%q: staleAfter can't be negative", i, h.Topic)
+		}
+		if h.MaxInterval < 0 {
+			return fmt.Errorf("history[%d] topic=%q: maxInterval can't be negative", i, h.Topic)
+		}
+		if h.MinSpacing < 0 {
+			return fmt.Errorf("history[%d] topic=%q: minSpacing can't be negative", i, h.Topic)
+		}
+		for pattern, d := range h.Deadband {
+			if d.Abs < 0 || d.Pct < 0 {
+				return fmt.Errorf("history[%d] topic=%q: deadband %q can't be negative", i, h.Topic, pattern)
+			}
+		}
+		for _, pattern := range slices.Concat(h.StringKeys, h.Include, h.Exclude, slices.Collect(maps.Keys(h.Deadband))) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("history[%d] topic=%q: bad key pattern %q", i, h.Topic, pattern)
+			}
+		}
+		if prev, ok := seen[h.Topic]; ok {
+			return fmt.Errorf("history[%d] topic=%q: duplicate of history[%d]", i, h.Topic, prev)
+		}
+		seen[h.Topic] = i
+	}
+
+	return nil
+}
+
+// daikinTopic returns the virtual device topic for the given Daikin ID.
+func daikinTopic(id string) string {
+	return fmt.Sprintf("virt/daikin-ac/%s", id)
+}
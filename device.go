@@ -1,10 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"math/rand/v2"
 	"strings"
 	"sync"
 	"time"
@@ -13,12 +14,115 @@ import (
 )
 
 const (
-	defaultTimeout = time.Second * 20
+	defaultTimeout      = time.Second * 20
+	defaultOfflineAfter = 3
+	failureBackoff      = time.Second
+	maxFailureBackoff   = time.Minute
 )
 
+// DeviceOptions configures a device created by Register.
+type DeviceOptions struct {
+	// OfflineAfter is the number of consecutive handler failures after which the device is marked offline on "<topic>/availability".
+	// Defaults to defaultOfflineAfter.
+	OfflineAfter int
+
+	// Retain publishes state with the MQTT retain flag.
+	// On startup, any previously retained state is read back as the last-known state.
+	Retain bool
+
+	// PollEvery, if non-zero, runs the handler on this schedule as if "/get" was received.
+	// Each interval is jittered by up to ±10%, and the first poll happens at a random point within the first interval.
+	PollEvery time.Duration
+
+	// StaleAfter, if non-zero, is how long the device can go without the handler succeeding before it is unhealthy.
+	StaleAfter time.Duration
+}
+
+// deviceState is the last-known state of a device.
+type deviceState struct {
+	lock      sync.Mutex
+	payload   json.RawMessage
+	at        time.Time
+	recovered bool // payload was read back from a retained message, not from the handler
+}
+
+// update sets the state as announced by the handler.
+func (ds *deviceState) update(payload json.RawMessage) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	ds.payload = payload
+	ds.at = time.Now()
+	ds.recovered = false
+}
+
+// get returns the last-known state, or nil if there is none.
+func (ds *deviceState) get() (payload json.RawMessage, at time.Time, recovered bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return ds.payload, ds.at, ds.recovered
+}
+
+// recover sets the state from a retained message, only if there's no state yet.
+func (ds *deviceState) recover(payload json.RawMessage) (ok bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	if ds.payload != nil {
+		return false
+	}
+	ds.payload = payload
+	ds.at = time.Now()
+	ds.recovered = true
+	return true
+}
+
+// deviceBackoff tracks consecutive handler failures, so that polling backs off from a failing device.
+type deviceBackoff struct {
+	lock     sync.Mutex
+	failures int
+	until    time.Time
+}
+
+// fail records a failure, returning the number of consecutive failures.
+func (b *deviceBackoff) fail() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	b.until = time.Now().Add(min(failureBackoff<<min(b.failures-1, 6), maxFailureBackoff))
+	return b.failures
+}
+
+func (b *deviceBackoff) succeed() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures = 0
+	b.until = time.Time{}
+}
+
+// wait returns how long to wait before polling again, or zero if not backing off.
+func (b *deviceBackoff) wait() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return max(time.Until(b.until), 0)
+}
+
 type devicePacket struct {
 	payload []byte
 	get     bool
+	respond func(setResult) // optional, for "/set"
+}
+
+// setResult is the outcome of a "/set".
+// It's published to the MQTT v5 response topic if one was given, otherwise to "<topic>/set/result".
+type setResult struct {
+	Success bool            `json:"success"`
+	State   json.RawMessage `json:"state,omitempty"` // state after the set was applied
+	Error   string          `json:"error,omitempty"`
+
+	invalid bool // the set was rejected before reaching the device
 }
 
 // HandlerFunc is used to handle a z2m-like virtual node.
@@ -28,87 +132,368 @@ type HandlerFunc[Set, Read any] func(ctx context.Context, readSet func() (out *S
 
 // Register creates a virtual z2m-like virtual device rooted at the given topic.
 // The handler must use the `readSet` function to check if there's data to send, otherwise it will be called forever.
-func Register[Set, Read any](pw *pahoWrap, topic string, handler HandlerFunc[Set, Read]) {
+// The device is removed when the passed context is cancelled, or via the returned stop func, which also waits for any in-flight handler call.
+// While running, the device is also listed in the registry, so it can be read and set over HTTP.
+// Options may be nil.
+func Register[Set, Read any](ctx context.Context, pw *pahoWrap, topic string, opts *DeviceOptions, handler HandlerFunc[Set, Read]) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	logger := topicLogger(logDevice, topic)
+
+	if opts == nil {
+		opts = &DeviceOptions{}
+	}
+	offlineAfter := defaultOfflineAfter
+	if opts.OfflineAfter > 0 {
+		offlineAfter = opts.OfflineAfter
+	}
+
+	var state deviceState
 
-	announce := func(out Read) {
-		// failure to Marshal/Publish are fatal problems
-		payload, err := json.Marshal(out)
+	// only modified by sender or after runner is done, which never run concurrently
+	var available string
+
+	var backoff deviceBackoff // also used by poll
+
+	topicAvailability := fmt.Sprintf("%s/availability", topic)
+	setAvailable := func(next string) {
+		if next == available {
+			return
+		}
+		available = next
+		err := pw.publish(&paho.Publish{Topic: topicAvailability, Payload: []byte(next), QoS: 1, Retain: true})
 		if err != nil {
-			log.Fatalf("couldn't JSON-encode output for topic=%v out=%+v err=%v", topic, out, err)
+			logger.Warn("failed to announce availability", "err", err)
 		}
-		_, err = pw.c.Publish(pw.ctx, &paho.Publish{Topic: topic, Payload: payload})
+	}
+
+	announce := func(out Read) (payload []byte, err error) {
+		payload, err = json.Marshal(out)
 		if err != nil {
-			log.Fatalf("failed to publish for topic=%v err=%v", topic, err)
+			return nil, fmt.Errorf("couldn't JSON-encode output: %w", err)
+		}
+		state.update(payload)
+		metricState.replace(topic, stateMetrics(payload))
+		hub.broadcast(event{Type: "state", Topic: topic, At: time.Now(), Data: json.RawMessage(payload)})
+		return payload, pw.publish(&paho.Publish{Topic: topic, Payload: payload, Retain: opts.Retain})
+	}
+
+	countSet := func(result setResult) {
+		if result.Success {
+			metricSets.add(1, topic, "success")
+		} else {
+			metricSets.add(1, topic, "error")
+		}
+	}
+
+	topicSetResult := fmt.Sprintf("%s/set/result", topic)
+	respondVia := func(p *paho.Publish) func(setResult) {
+		out := &paho.Publish{Topic: topicSetResult, QoS: 1}
+		if p.Properties != nil && p.Properties.ResponseTopic != "" {
+			out.Topic = p.Properties.ResponseTopic
+			out.Properties = &paho.PublishProperties{CorrelationData: p.Properties.CorrelationData}
+		}
+
+		return func(result setResult) {
+			countSet(result)
+
+			var err error
+			out.Payload, err = json.Marshal(result)
+			if err == nil {
+				err = pw.publish(out)
+			}
+			if err != nil {
+				logger.Warn("failed to respond to set", "err", err)
+			}
+		}
+	}
+
+	// recoverState reads back state retained from a previous run
+	recoverState := func(payload []byte) {
+		var out Read
+		err := json.Unmarshal(payload, &out)
+		if err != nil {
+			logger.Warn("ignoring bad retained state", "err", err)
+			return
+		}
+		if state.recover(payload) {
+			logger.Info("recovered retained state")
 		}
 	}
 
 	topicAll := fmt.Sprintf("%s/#", topic)
 	ch := make(chan devicePacket)
 
-	pw.router.RegisterHandler(topicAll, func(p *paho.Publish) {
-		if strings.HasSuffix(p.Topic, "/set") {
-			ch <- devicePacket{payload: p.Payload}
+	remove := pw.handle(topicAll, func(p *paho.Publish) {
+		var packet devicePacket
+		if p.Topic == topic {
+			// "topic/#" includes topic itself; retained state is sent on subscribe
+			if opts.Retain && p.Retain {
+				recoverState(p.Payload)
+			}
+			return
+		} else if strings.HasSuffix(p.Topic, "/set") {
+			packet = devicePacket{payload: p.Payload, respond: respondVia(p)}
 		} else if strings.HasSuffix(p.Topic, "/get") {
-			ch <- devicePacket{get: true}
+			packet = devicePacket{get: true}
+		} else {
+			return
 		}
-	})
 
-	_, err := pw.c.Subscribe(context.Background(), &paho.Subscribe{
-		Subscriptions: []paho.SubscribeOptions{
-			{Topic: topicAll, QoS: 1},
-		},
+		select {
+		case ch <- packet:
+		case <-ctx.Done():
+		}
 	})
+
+	err := pw.subscribe(topicAll, 1)
 	if err != nil {
-		log.Fatalf("failed to subscrive to topicAll=%v err=%v", topicAll, err)
+		logger.Warn("could not subscribe, will retry on reconnect", "err", err)
 	}
 
-	sender := func(readSet func() *Set) {
-		timeoutCtx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	unregister := deviceRegistry.add(topic, &registeredDevice{
+		topic:      topic,
+		state:      &state,
+		started:    time.Now(),
+		staleAfter: opts.StaleAfter,
+		submit: func(reqCtx context.Context, payload []byte) (result setResult, ok bool) {
+			resultCh := make(chan setResult, 1)
+			packet := devicePacket{payload: payload, respond: func(result setResult) {
+				countSet(result)
+				resultCh <- result
+			}}
+
+			select {
+			case ch <- packet:
+			case <-ctx.Done():
+				return result, false
+			case <-reqCtx.Done():
+				return result, false
+			}
+
+			select {
+			case result = <-resultCh:
+				return result, true
+			case <-reqCtx.Done():
+				return result, false
+			}
+		},
+	})
+
+	sender := func(readSet func() (*Set, []func(setResult))) error {
+		// the handler isn't cancelled with the device, but its logs follow the device's level
+		timeoutCtx, cancel := context.WithTimeout(withLogTopic(context.Background(), topic), defaultTimeout)
 		defer cancel()
 
-		out, err := handler(timeoutCtx, readSet)
+		// respond to every set the handler read, whether it succeeds or fails; runner responds to any it didn't read
+		var responders []func(setResult)
+		respondAll := func(result setResult) {
+			for _, respond := range responders {
+				respond(result)
+			}
+		}
+
+		start := time.Now()
+		out, err := handler(timeoutCtx, func() *Set {
+			set, r := readSet()
+			responders = append(responders, r...)
+			return set
+		})
+		duration := time.Since(start)
+		metricHandlerSeconds.observe(duration.Seconds(), topic)
 		if err != nil {
-			log.Printf("failed to operate on topic=%v err=%v", topic, err)
-			return // "valid" err, just failed to do thing
+			logger.Warn("failed to operate", "duration", duration, "err", err)
+			metricHandlerErrors.add(1, topic)
+			respondAll(setResult{Error: err.Error()})
+			if backoff.fail() >= offlineAfter {
+				setAvailable(availabilityOffline)
+			}
+			return err // "valid" err, just failed to do thing
 		}
-		announce(out)
+		backoff.succeed()
+		setAvailable(availabilityOnline)
+		logger.Debug("handled", "duration", duration)
+
+		payload, err := announce(out)
+		if err != nil {
+			logger.Warn("failed to announce", "err", err)
+		}
+		respondAll(setResult{Success: true, State: payload})
+		return nil
 	}
-	go runner(ch, sender)
+
+	done := make(chan struct{})
+	go func() {
+		runner(ctx, ch, sender)
+		close(done)
+	}()
+
+	if opts.PollEvery > 0 {
+		go poll(ctx, opts.PollEvery, &backoff, ch)
+	}
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			remove()
+			unregister()
+			<-done
+			setAvailable(availabilityOffline)
+			metricState.forget(topic)
+
+			err := pw.unsubscribe(topicAll)
+			if err != nil {
+				logger.Warn("failed to unsubscribe", "err", err)
+			}
+		})
+	}
+	context.AfterFunc(ctx, func() { go stop() })
+
+	return stop
 }
 
-func runner[Set any](packetCh <-chan devicePacket, handler func(readSet func() *Set)) {
+// stateMetrics returns the top-level numbers and bools in the given JSON state, bools as 0 or 1.
+func stateMetrics(payload []byte) (out map[string]float64) {
+	var values map[string]any
+	json.Unmarshal(payload, &values) // not an object: no metrics
+
+	out = map[string]float64{}
+	for key, value := range values {
+		switch v := value.(type) {
+		case float64:
+			out[key] = v
+		case bool:
+			out[key] = 0
+			if v {
+				out[key] = 1
+			}
+		}
+	}
+	return out
+}
+
+// poll sends a "/get" packet to ch on a jittered schedule until ctx is done.
+// While the device is failing, polls are delayed until its backoff has passed.
+func poll(ctx context.Context, every time.Duration, backoff *deviceBackoff, ch chan<- devicePacket) {
+	t := time.NewTimer(rand.N(every))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if wait := backoff.wait(); wait > 0 {
+			t.Reset(wait)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- devicePacket{get: true}:
+		}
+
+		jitter := time.Duration((rand.Float64()*0.2 - 0.1) * float64(every))
+		t.Reset(every + jitter)
+	}
+}
+
+// SetValidator may be implemented by a device's Set type (on its pointer) to reject invalid "/set" payloads.
+// It is called on the Set merged from all pending "/set" payloads, before it can reach the device.
+type SetValidator interface {
+	Validate() error
+}
+
+// decodeSet strictly decodes the given "/set" packets' payloads over each other in order, and validates the result.
+func decodeSet[Set any](packets []devicePacket) (*Set, error) {
+	var set Set
+	for _, packet := range packets {
+		dec := json.NewDecoder(bytes.NewReader(packet.payload))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&set)
+		if err != nil {
+			return nil, err
+		}
+		if dec.More() {
+			return nil, fmt.Errorf("unexpected data after JSON object")
+		}
+	}
+
+	if v, ok := any(&set).(SetValidator); ok {
+		err := v.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &set, nil
+}
+
+// rejectSets responds to each "/set" packet with the given error, as it was rejected before reaching the device.
+func rejectSets(packets []devicePacket, err error) {
+	for _, packet := range packets {
+		if packet.respond != nil {
+			packet.respond(setResult{Error: fmt.Sprintf("invalid set: %v", err), invalid: true})
+		}
+	}
+}
+
+// runner calls handler for incoming packets, coalescing any that arrive while it is running.
+// Each "/set" payload is decoded and validated with decodeSet along with those already pending, and is rejected via its responder if invalid.
+// If the handler fails without calling readSet, the packets it was called for are dropped rather than retried immediately, but any which arrived during the call are kept for the next.
+// The handler's readSet returns the pending Set along with the responders of every "/set" merged into it, and "/set"s dropped on failure are responded to with the handler's error.
+// It returns once ctx is done and any in-flight handler has returned.
+func runner[Set any](ctx context.Context, packetCh <-chan devicePacket, handler func(readSet func() (*Set, []func(setResult))) error) {
 	neverCh := make(chan bool)
 	tokenCh := make(chan bool, 1)
 	tokenCh <- true
 
 	var lock sync.Mutex
 	var pending bool
-	var set *Set
+	var set *Set            // merged from sets, or nil
+	var sets []devicePacket // valid "/set" packets
+	var received int        // packets so far
+	var read bool           // readSet was called during the current handler call
 
-	readSet := func() (out *Set) {
+	readSet := func() (out *Set, respond []func(setResult)) {
 		lock.Lock()
 		defer lock.Unlock()
 
 		pending = false // users must invoke readSet to clear this bit
+		read = true
+		for _, packet := range sets {
+			if packet.respond != nil {
+				respond = append(respond, packet.respond)
+			}
+		}
 		out = set
-		set = nil
-		return out
+		set, sets = nil, nil
+		return out, respond
 	}
 
 	var packet devicePacket
 
 	for {
+		var rejectErr error
 		lock.Lock()
 
-		if packet.get || packet.payload != nil {
+		if packet.get {
 			pending = true
+			received++
 		}
 		if packet.payload != nil {
-			if set == nil {
-				var actual Set
-				set = &actual
+			// rebuild rather than merging into set, which may share pointers with an earlier payload
+			next, err := decodeSet[Set](append(sets[:len(sets):len(sets)], packet))
+			if err != nil {
+				rejectErr = err
+			} else {
+				set = next
+				sets = append(sets, packet)
+				pending = true
+				received++
 			}
-			json.Unmarshal(packet.payload, set)
 		}
 
 		ch := neverCh // we don't want to run the handler yet (will never trigger)
@@ -118,16 +503,65 @@ func runner[Set any](packetCh <-chan devicePacket, handler func(readSet func() *
 
 		lock.Unlock()
 
+		if rejectErr != nil {
+			rejectSets([]devicePacket{packet}, rejectErr)
+		}
+
 		select {
+		case <-ctx.Done():
+			<-tokenCh // wait for in-flight handler
+			for _, packet := range sets {
+				if packet.respond != nil {
+					packet.respond(setResult{Error: "device stopped"})
+				}
+			}
+			return
 		case packet = <-packetCh:
 			continue
 		case <-ch:
 			packet = devicePacket{}
 		}
 
+		lock.Lock()
+		if !pending {
+			// the previous handler read or dropped everything while we waited for its token
+			lock.Unlock()
+			tokenCh <- true
+			continue
+		}
+		read = false
+		startReceived, startSets := received, len(sets)
+		lock.Unlock()
+
 		// token available and we're pending: kickoff task
 		go func() {
-			handler(readSet)
+			err := handler(readSet)
+			if err != nil {
+				var dropped, invalid []devicePacket
+				var invalidErr error
+				lock.Lock()
+				if !read {
+					dropped, sets = sets[:startSets], sets[startSets:]
+					pending = received != startReceived
+
+					set = nil
+					if len(sets) != 0 {
+						// the remaining sets were valid merged with those dropped, but may not be alone
+						set, invalidErr = decodeSet[Set](sets)
+						if invalidErr != nil {
+							invalid, sets = sets, nil
+						}
+					}
+				}
+				lock.Unlock()
+
+				for _, packet := range dropped {
+					if packet.respond != nil {
+						packet.respond(setResult{Error: err.Error()})
+					}
+				}
+				rejectSets(invalid, invalidErr)
+			}
 			tokenCh <- true // return token
 		}()
 	}
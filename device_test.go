@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type testSet struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+func (s *testSet) Validate() error {
+	if s.A < 0 {
+		return errors.New("a can't be negative")
+	}
+	return nil
+}
+
+// runnerCall is a call to a handler passed to runner, which returns once result is sent to.
+type runnerCall struct {
+	readSet func() (*testSet, []func(setResult))
+	result  chan error
+}
+
+// set reads the pending set, responding to each merged "/set" with success.
+func (c runnerCall) set() *testSet {
+	set, responders := c.readSet()
+	for _, respond := range responders {
+		respond(setResult{Success: true})
+	}
+	return set
+}
+
+// startRunner starts runner with a handler which sends each call to the returned channel.
+func startRunner(t *testing.T) (packetCh chan devicePacket, calls chan runnerCall) {
+	ctx, cancel := context.WithCancel(context.Background())
+	packetCh = make(chan devicePacket)
+	calls = make(chan runnerCall)
+
+	done := make(chan struct{})
+	go func() {
+		runner(ctx, packetCh, func(readSet func() (*testSet, []func(setResult))) error {
+			call := runnerCall{readSet: readSet, result: make(chan error)}
+			calls <- call
+			return <-call.result
+		})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return packetCh, calls
+}
+
+func nextCall(t *testing.T, calls chan runnerCall) runnerCall {
+	t.Helper()
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(time.Second):
+		t.Fatal("handler not called")
+		return runnerCall{}
+	}
+}
+
+func noCall(t *testing.T, calls chan runnerCall) {
+	t.Helper()
+	select {
+	case <-calls:
+		t.Fatal("unexpected handler call")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestRunnerCoalesce(t *testing.T) {
+	packetCh, calls := startRunner(t)
+
+	packetCh <- devicePacket{get: true}
+	first := nextCall(t, calls)
+
+	// these arrive while the first call is running
+	packetCh <- devicePacket{payload: []byte(`{"a":1}`)}
+	packetCh <- devicePacket{get: true}
+	packetCh <- devicePacket{payload: []byte(`{"b":2}`)}
+	packetCh <- devicePacket{payload: []byte(`{"a":3}`)}
+
+	if set := first.set(); set == nil || *set != (testSet{A: 3, B: 2}) {
+		t.Errorf("got set %+v, want merged", set)
+	}
+	first.result <- nil
+
+	// everything was read by the first call
+	noCall(t, calls)
+
+	packetCh <- devicePacket{payload: []byte(`{"b":4}`)}
+	second := nextCall(t, calls)
+	if set := second.set(); set == nil || *set != (testSet{B: 4}) {
+		t.Errorf("got set %+v, want only the new set", set)
+	}
+	second.result <- nil
+}
+
+func TestRunnerFailure(t *testing.T) {
+	packetCh, calls := startRunner(t)
+
+	// fails without reading: not retried until something new arrives
+	packetCh <- devicePacket{payload: []byte(`{"a":1}`)}
+	call := nextCall(t, calls)
+	call.result <- errors.New("failed")
+	noCall(t, calls)
+
+	// fails without reading, but a set arrives meanwhile: only that is kept
+	packetCh <- devicePacket{payload: []byte(`{"a":2}`)}
+	call = nextCall(t, calls)
+	packetCh <- devicePacket{payload: []byte(`{"b":3}`)}
+	call.result <- errors.New("failed")
+
+	call = nextCall(t, calls)
+	if set := call.set(); set == nil || *set != (testSet{B: 3}) {
+		t.Errorf("got set %+v, want only the set which arrived during the failed call", set)
+	}
+	call.result <- errors.New("failed")
+	noCall(t, calls)
+
+	// a get is called for even after failures
+	packetCh <- devicePacket{get: true}
+	call = nextCall(t, calls)
+	if set := call.set(); set != nil {
+		t.Errorf("got set %+v, want nil", set)
+	}
+	call.result <- nil
+}
+
+func TestRunnerRespond(t *testing.T) {
+	packetCh, calls := startRunner(t)
+
+	results := make(chan string, 10)
+	setPacket := func(id, payload string) devicePacket {
+		return devicePacket{payload: []byte(payload), respond: func(r setResult) {
+			results <- id + ":" + r.Error
+		}}
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case got := <-results:
+				if got != w {
+					t.Errorf("got result %q, want %q", got, w)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("missing result %q", w)
+			}
+		}
+		select {
+		case got := <-results:
+			t.Errorf("unexpected result %q", got)
+		default:
+		}
+	}
+
+	// the handler fails without reading: only "/set"s from before it started get its error
+	packetCh <- setPacket("first", `{"a":1}`)
+	call := nextCall(t, calls)
+	packetCh <- setPacket("second", `{"b":2}`)
+	call.result <- errors.New("unreachable")
+	expect("first:unreachable")
+
+	call = nextCall(t, calls)
+	if set := call.set(); set == nil || *set != (testSet{B: 2}) {
+		t.Errorf("got set %+v, want only the second", set)
+	}
+	call.result <- nil
+	expect("second:")
+}
+
+func TestDecodeSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		payloads []string
+		want     testSet
+		wantErr  bool
+	}{
+		{"single", []string{`{"a":1}`}, testSet{A: 1}, false},
+		{"merged", []string{`{"a":1}`, `{"b":2}`, `{"a":3}`}, testSet{A: 3, B: 2}, false},
+		{"unknown field", []string{`{"c":1}`}, testSet{}, true},
+		{"wrong type", []string{`{"a":"1"}`}, testSet{}, true},
+		{"not an object", []string{`[1]`}, testSet{}, true},
+		{"trailing data", []string{`{"a":1} {"a":2}`}, testSet{}, true},
+		{"invalid", []string{`{"a":-1}`}, testSet{}, true},
+		{"invalid once merged", []string{`{"a":1}`, `{"a":-1}`}, testSet{}, true},
+		{"valid once merged", []string{`{"a":-1}`, `{"a":1}`}, testSet{A: 1}, false},
+	}
+
+	for _, tt := range tests {
+		var packets []devicePacket
+		for _, payload := range tt.payloads {
+			packets = append(packets, devicePacket{payload: []byte(payload)})
+		}
+		got, err := decodeSet[testSet](packets)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got err=%v, want error=%v", tt.name, err, tt.wantErr)
+		} else if err == nil && *got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestRunnerReject(t *testing.T) {
+	packetCh, calls := startRunner(t)
+
+	results := make(chan setResult, 10)
+	respond := func(r setResult) { results <- r }
+
+	packetCh <- devicePacket{payload: []byte(`{"a":-1}`), respond: respond}
+	if r := <-results; r.Success || r.Error == "" {
+		t.Errorf("got %+v, want invalid set", r)
+	}
+	noCall(t, calls) // never reached the handler
+
+	packetCh <- devicePacket{payload: []byte(`{"b":1}`), respond: respond}
+	call := nextCall(t, calls)
+	if set := call.set(); set == nil || *set != (testSet{B: 1}) {
+		t.Errorf("got set %+v", set)
+	}
+	call.result <- nil
+	if r := <-results; !r.Success {
+		t.Errorf("got %+v, want success", r)
+	}
+}
+
+func TestDeviceBackoff(t *testing.T) {
+	var b deviceBackoff
+	if b.wait() != 0 {
+		t.Errorf("expected no wait initially")
+	}
+
+	for i := 1; i <= 10; i++ {
+		if got := b.fail(); got != i {
+			t.Errorf("got %d failures, want %d", got, i)
+		}
+	}
+	if wait := b.wait(); wait <= maxFailureBackoff-time.Second || wait > maxFailureBackoff {
+		t.Errorf("got wait %v, want about %v", wait, maxFailureBackoff)
+	}
+
+	b.succeed()
+	if b.wait() != 0 {
+		t.Errorf("expected no wait after success")
+	}
+}
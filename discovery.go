@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/samthor/daikinac"
+	"github.com/samthor/gohaus/api/daikin"
+)
+
+// haEntity is a Home Assistant MQTT discovery config.
+// See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery.
+type haEntity struct {
+	component string // e.g., "climate", "sensor"
+	objectID  string
+
+	Name             string           `json:"name"`
+	UniqueID         string           `json:"unique_id"`
+	Device           haDevice         `json:"device"`
+	Availability     []haAvailability `json:"availability"`
+	AvailabilityMode string           `json:"availability_mode"`
+
+	// sensor, binary_sensor
+
+	StateTopic        string `json:"state_topic,omitempty"`
+	ValueTemplate     string `json:"value_template,omitempty"`
+	DeviceClass       string `json:"device_class,omitempty"`
+	StateClass        string `json:"state_class,omitempty"`
+	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
+
+	// climate
+
+	Modes                      []string `json:"modes,omitempty"`
+	ModeStateTopic             string   `json:"mode_state_topic,omitempty"`
+	ModeStateTemplate          string   `json:"mode_state_template,omitempty"`
+	ModeCommandTopic           string   `json:"mode_command_topic,omitempty"`
+	ModeCommandTemplate        string   `json:"mode_command_template,omitempty"`
+	FanModes                   []string `json:"fan_modes,omitempty"`
+	FanModeStateTopic          string   `json:"fan_mode_state_topic,omitempty"`
+	FanModeStateTemplate       string   `json:"fan_mode_state_template,omitempty"`
+	FanModeCommandTopic        string   `json:"fan_mode_command_topic,omitempty"`
+	FanModeCommandTemplate     string   `json:"fan_mode_command_template,omitempty"`
+	TemperatureStateTopic      string   `json:"temperature_state_topic,omitempty"`
+	TemperatureStateTemplate   string   `json:"temperature_state_template,omitempty"`
+	TemperatureCommandTopic    string   `json:"temperature_command_topic,omitempty"`
+	TemperatureCommandTemplate string   `json:"temperature_command_template,omitempty"`
+	CurrentTemperatureTopic    string   `json:"current_temperature_topic,omitempty"`
+	CurrentTemperatureTemplate string   `json:"current_temperature_template,omitempty"`
+	TemperatureUnit            string   `json:"temperature_unit,omitempty"`
+	MinTemp                    float64  `json:"min_temp,omitempty"`
+	MaxTemp                    float64  `json:"max_temp,omitempty"`
+	TempStep                   float64  `json:"temp_step,omitempty"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+var (
+	// daikinHAModes maps Daikin modes to Home Assistant HVAC modes; "off" is derived from power
+	daikinHAModes = map[daikinac.Mode]string{
+		daikinac.ModeAuto: "auto",
+		daikinac.ModeDry:  "dry",
+		daikinac.ModeCool: "cool",
+		daikinac.ModeHeat: "heat",
+		daikinac.ModeFan:  "fan_only",
+	}
+
+	// daikinHAFanModes maps Daikin fan rates to Home Assistant fan modes
+	daikinHAFanModes = map[daikinac.FanRate]string{
+		daikinac.FanAuto:  "auto",
+		daikinac.FanQuiet: "quiet",
+		3:                 "1",
+		4:                 "2",
+		5:                 "3",
+		6:                 "4",
+		7:                 "5",
+	}
+
+	invalidObjectID = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+// newHAEntity returns an entity attached to the device at the given topic.
+func newHAEntity(pw *pahoWrap, component, topic, suffix, name string, device haDevice) haEntity {
+	objectID := invalidObjectID.ReplaceAllString(fmt.Sprintf("gohaus_%s_%s", topic, suffix), "_")
+	return haEntity{
+		component: component,
+		objectID:  objectID,
+
+		Name:     name,
+		UniqueID: objectID,
+		Device:   device,
+		Availability: []haAvailability{
+			{Topic: pw.availabilityTopic},
+			{Topic: fmt.Sprintf("%s/availability", topic)},
+		},
+		AvailabilityMode: "all",
+	}
+}
+
+func newHADevice(topic, name, manufacturer, model string) haDevice {
+	return haDevice{
+		Identifiers:  []string{invalidObjectID.ReplaceAllString(fmt.Sprintf("gohaus_%s", topic), "_")},
+		Name:         name,
+		Manufacturer: manufacturer,
+		Model:        model,
+	}
+}
+
+// jinjaMap renders a Go map as a Jinja dict literal, for use in templates.
+func jinjaMap[K comparable, V any](m map[K]V) string {
+	var parts []string
+	for k, v := range m {
+		kb, _ := json.Marshal(k)
+		vb, _ := json.Marshal(v)
+		parts = append(parts, fmt.Sprintf("%s:%s", kb, vb))
+	}
+	slices.Sort(parts)
+	return fmt.Sprintf("{%s}", strings.Join(parts, ","))
+}
+
+func invertMap[K, V comparable](m map[K]V) map[V]K {
+	out := make(map[V]K, len(m))
+	for k, v := range m {
+		out[v] = k
+	}
+	return out
+}
+
+// daikinDiscovery returns the entities for a Daikin AC published at topic, whose values are daikin.DaikinValues.
+func daikinDiscovery(pw *pahoWrap, topic, id string) []haEntity {
+	device := newHADevice(topic, fmt.Sprintf("AC %s", id), "Daikin", "")
+	setTopic := fmt.Sprintf("%s/set", topic)
+
+	modes := []string{"off"}
+	for _, m := range daikinHAModes {
+		modes = append(modes, m)
+	}
+	slices.Sort(modes[1:])
+
+	var fanModes []string
+	for _, rate := range slices.Sorted(maps.Keys(daikinHAFanModes)) {
+		fanModes = append(fanModes, daikinHAFanModes[rate])
+	}
+
+	climate := newHAEntity(pw, "climate", topic, "climate", "Climate", device)
+	climate.Modes = modes
+	climate.ModeStateTopic = topic
+	climate.ModeStateTemplate = fmt.Sprintf("{%% if not value_json.power %%}off{%% else %%}{{ %s.get(value_json.mode, 'auto') }}{%% endif %%}", jinjaMap(daikinHAModes))
+	climate.ModeCommandTopic = setTopic
+	climate.ModeCommandTemplate = fmt.Sprintf(`{%% if value == 'off' %%}{"power":false}{%% else %%}{"power":true,"mode":{{ %s[value] }}}{%% endif %%}`, jinjaMap(invertMap(daikinHAModes)))
+	climate.FanModes = fanModes
+	climate.FanModeStateTopic = topic
+	climate.FanModeStateTemplate = fmt.Sprintf("{{ %s.get(value_json.fanRate, 'auto') }}", jinjaMap(daikinHAFanModes))
+	climate.FanModeCommandTopic = setTopic
+	climate.FanModeCommandTemplate = fmt.Sprintf(`{"fanRate":{{ %s[value] }}}`, jinjaMap(invertMap(daikinHAFanModes)))
+	climate.TemperatureStateTopic = topic
+	climate.TemperatureStateTemplate = "{{ value_json.setTemp }}"
+	climate.TemperatureCommandTopic = setTopic
+	climate.TemperatureCommandTemplate = `{"setTemp":{{ value }}}`
+	climate.CurrentTemperatureTopic = topic
+	climate.CurrentTemperatureTemplate = "{{ value_json.homeTemp }}"
+	climate.TemperatureUnit = "C"
+	climate.MinTemp = daikin.MinSetTemp
+	climate.MaxTemp = daikin.MaxSetTemp
+	climate.TempStep = 0.5
+
+	outside := newHAEntity(pw, "sensor", topic, "outside_temp", "Outside temperature", device)
+	outside.StateTopic = topic
+	outside.ValueTemplate = "{{ value_json.outsideTemp }}"
+	outside.DeviceClass = "temperature"
+	outside.StateClass = "measurement"
+	outside.UnitOfMeasurement = "°C"
+
+	return []haEntity{climate, outside}
+}
+
+// powerwallDiscovery returns the entities for a Powerwall published at topic, whose values are powerwall.SimpleStatus.
+func powerwallDiscovery(pw *pahoWrap, topic string) (out []haEntity) {
+	device := newHADevice(topic, "Powerwall", "Tesla", "Powerwall")
+
+	sensor := func(key, name, deviceClass, unit, template string) {
+		if template == "" {
+			template = fmt.Sprintf("{{ value_json.%s }}", key)
+		}
+		e := newHAEntity(pw, "sensor", topic, key, name, device)
+		e.StateTopic = topic
+		e.ValueTemplate = template
+		e.DeviceClass = deviceClass
+		e.StateClass = "measurement"
+		e.UnitOfMeasurement = unit
+		out = append(out, e)
+	}
+	binarySensor := func(key, name, deviceClass string) {
+		e := newHAEntity(pw, "binary_sensor", topic, key, name, device)
+		e.StateTopic = topic
+		e.ValueTemplate = fmt.Sprintf("{{ 'ON' if value_json.%s else 'OFF' }}", key)
+		e.DeviceClass = deviceClass
+		out = append(out, e)
+	}
+
+	sensor("powerBattery", "Battery power", "power", "W", "")
+	sensor("powerSite", "Grid power", "power", "W", "")
+	sensor("powerLoad", "Load power", "power", "W", "")
+	sensor("powerSolar", "Solar power", "power", "W", "")
+	sensor("powerSolarRGM", "Solar RGM power", "power", "W", "")
+	sensor("powerGenerator", "Generator power", "power", "W", "")
+	sensor("powerConductor", "Conductor power", "power", "W", "")
+	sensor("battery", "Battery energy", "energy_storage", "Wh", "")
+	sensor("batteryFull", "Battery full energy", "energy_storage", "Wh", "")
+	sensor("batteryPercent", "Battery", "battery", "%", "{{ (100 * value_json.battery / value_json.batteryFull) | round(1) if value_json.batteryFull else None }}")
+	binarySensor("island", "Island", "problem")
+	binarySensor("shutdown", "Shutdown", "problem")
+
+	return out
+}
+
+func (e *haEntity) configTopic(prefix string) string {
+	return fmt.Sprintf("%s/%s/%s/config", prefix, e.component, e.objectID)
+}
+
+// announceDiscovery publishes the given discovery configs, and again whenever Home Assistant comes online.
+// The returned stop func stops republishing; configs are retained until forgetDiscovery is called.
+func announceDiscovery(pw *pahoWrap, prefix string, entities []haEntity) (stop func()) {
+	publish := func() {
+		for _, e := range entities {
+			payload, err := json.Marshal(e)
+			if err != nil {
+				logDiscovery.Error("couldn't JSON-encode discovery", "topic", e.configTopic(prefix), "err", err)
+				continue
+			}
+			err = pw.publish(&paho.Publish{Topic: e.configTopic(prefix), Payload: payload, QoS: 1, Retain: true})
+			if err != nil {
+				logDiscovery.Warn("failed to publish discovery", "topic", e.configTopic(prefix), "err", err)
+			}
+		}
+	}
+	go publish()
+
+	remove := pw.handle(fmt.Sprintf("%s/status", prefix), func(p *paho.Publish) {
+		if string(p.Payload) == availabilityOnline {
+			go publish()
+		}
+	})
+
+	var once sync.Once
+	return func() { once.Do(remove) }
+}
+
+// forgetDiscovery removes the given discovery configs, removing the entities from Home Assistant.
+func forgetDiscovery(pw *pahoWrap, prefix string, entities []haEntity) {
+	for _, e := range entities {
+		err := pw.publish(&paho.Publish{Topic: e.configTopic(prefix), QoS: 1, Retain: true})
+		if err != nil {
+			logDiscovery.Warn("failed to remove discovery", "topic", e.configTopic(prefix), "err", err)
+		}
+	}
+}
+
+// withDiscovery wraps the spec so that its Home Assistant entities are announced when started, and forgotten when removed.
+// They're also forgotten if prefix changes on reload, so they aren't left behind under the old prefix.
+// This does nothing if prefix is empty.
+func withDiscovery(pw *pahoWrap, prefix string, spec startSpec, entities []haEntity) startSpec {
+	if prefix == "" {
+		return spec
+	}
+
+	start := spec.start
+	return startSpec{
+		key: [2]any{spec.key, prefix},
+		start: func() (stop func()) {
+			stopDevice := start()
+			stopDiscovery := announceDiscovery(pw, prefix, entities)
+			return func() {
+				stopDiscovery()
+				stopDevice()
+			}
+		},
+		forget:    func() { forgetDiscovery(pw, prefix, entities) },
+		forgetKey: prefix,
+	}
+}
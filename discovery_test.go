@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDaikinDiscovery(t *testing.T) {
+	pw := &pahoWrap{availabilityTopic: "gohaus/availability"}
+	entities := daikinDiscovery(pw, "virt/daikin-ac/living-room", "living-room")
+
+	tests := []struct {
+		configTopic string
+		want        map[string]any
+	}{
+		{"homeassistant/climate/gohaus_virt_daikin-ac_living-room_climate/config", map[string]any{
+			"unique_id":               "gohaus_virt_daikin-ac_living-room_climate",
+			"mode_command_topic":      "virt/daikin-ac/living-room/set",
+			"temperature_state_topic": "virt/daikin-ac/living-room",
+			"modes":                   []any{"off", "auto", "cool", "dry", "fan_only", "heat"},
+			"fan_modes":               []any{"auto", "quiet", "1", "2", "3", "4", "5"},
+			"min_temp":                10.0,
+			"max_temp":                32.0,
+			"temperature_unit":        "C",
+			"availability_mode":       "all",
+			"availability":            []any{map[string]any{"topic": "gohaus/availability"}, map[string]any{"topic": "virt/daikin-ac/living-room/availability"}},
+		}},
+		{"homeassistant/sensor/gohaus_virt_daikin-ac_living-room_outside_temp/config", map[string]any{
+			"value_template":      "{{ value_json.outsideTemp }}",
+			"device_class":        "temperature",
+			"unit_of_measurement": "°C",
+		}},
+	}
+
+	if len(entities) != len(tests) {
+		t.Fatalf("got %d entities, want %d", len(entities), len(tests))
+	}
+	for i, tt := range tests {
+		checkDiscovery(t, entities[i], tt.configTopic, tt.want)
+	}
+}
+
+func TestPowerwallDiscovery(t *testing.T) {
+	pw := &pahoWrap{availabilityTopic: "gohaus/availability"}
+	byID := map[string]haEntity{}
+	for _, e := range powerwallDiscovery(pw, "virt/powerwall") {
+		byID[e.objectID] = e
+	}
+
+	tests := []struct {
+		objectID    string
+		configTopic string
+		want        map[string]any
+	}{
+		{"gohaus_virt_powerwall_powerSolar", "homeassistant/sensor/gohaus_virt_powerwall_powerSolar/config", map[string]any{
+			"state_topic":         "virt/powerwall",
+			"value_template":      "{{ value_json.powerSolar }}",
+			"device_class":        "power",
+			"state_class":         "measurement",
+			"unit_of_measurement": "W",
+		}},
+		{"gohaus_virt_powerwall_battery", "homeassistant/sensor/gohaus_virt_powerwall_battery/config", map[string]any{
+			"device_class":        "energy_storage",
+			"unit_of_measurement": "Wh",
+		}},
+		{"gohaus_virt_powerwall_island", "homeassistant/binary_sensor/gohaus_virt_powerwall_island/config", map[string]any{
+			"value_template": "{{ 'ON' if value_json.island else 'OFF' }}",
+			"device_class":   "problem",
+		}},
+	}
+
+	for _, tt := range tests {
+		e, ok := byID[tt.objectID]
+		if !ok {
+			t.Errorf("missing entity %s", tt.objectID)
+			continue
+		}
+		checkDiscovery(t, e, tt.configTopic, tt.want)
+	}
+}
+
+// checkDiscovery checks that the entity is published to configTopic, and that its JSON config includes want.
+func checkDiscovery(t *testing.T, e haEntity, configTopic string, want map[string]any) {
+	t.Helper()
+
+	if got := e.configTopic("homeassistant"); got != configTopic {
+		t.Errorf("got config topic %q, want %q", got, configTopic)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, v := range want {
+		gb, _ := json.Marshal(got[key])
+		wb, _ := json.Marshal(v)
+		if string(gb) != string(wb) {
+			t.Errorf("%s: got %s=%s, want %s", configTopic, key, gb, wb)
+		}
+	}
+}
+
+func TestJinjaMap(t *testing.T) {
+	got := jinjaMap(map[int]string{2: "b", 1: "a"})
+	if want := `{1:"a",2:"b"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
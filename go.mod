@@ -6,11 +6,11 @@ go 1.25.0
 
 require github.com/samthor/daikinac v0.0.0-20250816012424-ec0c7d7c3632
 
-require google.golang.org/protobuf v1.36.8 // indirect
+require google.golang.org/protobuf v1.36.8
 
 require (
-	github.com/eclipse/paho.golang v0.22.0 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/eclipse/paho.golang v0.22.0
+	github.com/gorilla/websocket v1.5.3
 	golang.org/x/net v0.27.0 // indirect
 	golang.org/x/sync v0.16.0
 )
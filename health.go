@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	maxHistoryBacklog = 100
+)
+
+type healthReport struct {
+	OK      bool                `json:"ok"`
+	MQTT    healthMQTT          `json:"mqtt"`
+	Devices []healthTopic       `json:"devices"`
+	History []healthTopic       `json:"history"`
+	Writer  healthHistoryWriter `json:"writer"`
+}
+
+type healthMQTT struct {
+	OK        bool `json:"ok"`
+	Connected bool `json:"connected"`
+}
+
+type healthTopic struct {
+	OK         bool      `json:"ok"`
+	Topic      string    `json:"topic"`
+	Last       time.Time `json:"last,omitzero"` // last success for devices, last packet for history
+	Age        string    `json:"age,omitempty"` // time since last, or since started if never
+	StaleAfter string    `json:"staleAfter,omitempty"`
+}
+
+type healthHistoryWriter struct {
+	OK      bool   `json:"ok"`
+	Backlog int64  `json:"backlog"`         // packets waiting to be written
+	Error   string `json:"error,omitempty"` // if writes are failing, and being retried
+}
+
+// checkTopic reports on something which last had data at last, and is stale without data for staleAfter.
+// Something with a staleAfter which has never had data is also not ok.
+func checkTopic(topic string, started, last time.Time, staleAfter time.Duration) healthTopic {
+	since := last
+	if since.IsZero() {
+		since = started
+	}
+	age := time.Since(since)
+
+	out := healthTopic{OK: true, Topic: topic, Last: last, Age: age.Round(time.Second).String()}
+	if staleAfter > 0 {
+		out.StaleAfter = staleAfter.String()
+		if age > staleAfter || last.IsZero() {
+			out.OK = false
+		}
+	}
+	return out
+}
+
+// checkHealth reports on MQTT, devices, history, and the history writer.
+func checkHealth(pw *pahoWrap) (out healthReport) {
+	out.MQTT.Connected = pw.connected.Load()
+	out.MQTT.OK = out.MQTT.Connected
+	out.OK = out.MQTT.OK
+
+	out.Devices = []healthTopic{}
+	for _, rd := range deviceRegistry.all() {
+		_, at, recovered := rd.state.get()
+		if recovered {
+			at = time.Time{} // not from the handler, so not a success
+		}
+		ht := checkTopic(rd.topic, rd.started, at, rd.staleAfter)
+		out.OK = out.OK && ht.OK
+		out.Devices = append(out.Devices, ht)
+	}
+
+	out.History = []healthTopic{}
+	for _, rh := range historyRegistry.all() {
+		ht := checkTopic(rh.topic, rh.started, rh.lastReceived(), rh.staleAfter)
+		out.OK = out.OK && ht.OK
+		out.History = append(out.History, ht)
+	}
+
+	out.Writer.Backlog = historyBacklog.Load()
+	out.Writer.Error, _ = historyWriteErr.Load().(string)
+	out.Writer.OK = out.Writer.Backlog <= maxHistoryBacklog && out.Writer.Error == ""
+	out.OK = out.OK && out.Writer.OK
+
+	return out
+}
+
+// handleHealthz handles `GET /healthz`, which reports liveness only: if this responds, the process is up.
+// It doesn't depend on MQTT or devices, so a broker or device outage doesn't cause a restart.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// readyHandler handles `GET /readyz`, reporting on MQTT, devices, history and the writer, and responding 503 if anything is unhealthy.
+// Every device and history topic with a staleAfter must have succeeded at least once to be ready.
+func readyHandler(pw *pahoWrap) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := checkHealth(pw)
+		status := http.StatusOK
+		if !report.OK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	}
+}
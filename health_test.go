@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckTopic(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		started    time.Time
+		last       time.Time
+		staleAfter time.Duration
+		want       bool
+	}{
+		{"no staleAfter, never", now.Add(-time.Hour), time.Time{}, 0, true},
+		{"no staleAfter, old", now.Add(-time.Hour), now.Add(-time.Hour), 0, true},
+		{"fresh", now.Add(-time.Hour), now.Add(-time.Second), time.Minute, true},
+		{"stale", now.Add(-time.Hour), now.Add(-time.Minute * 2), time.Minute, false},
+		{"never, just started", now, time.Time{}, time.Minute, false},
+		{"never, long ago", now.Add(-time.Hour), time.Time{}, time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		got := checkTopic("virt/x", tt.started, tt.last, tt.staleAfter)
+		if got.OK != tt.want {
+			t.Errorf("%s: ok=%v, want %v (%+v)", tt.name, got.OK, tt.want, got)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	// liveness doesn't depend on anything else, even a stale device
+	rd := &registeredDevice{topic: "virt/stale", state: &deviceState{}, started: time.Now().Add(-time.Hour), staleAfter: time.Minute}
+	t.Cleanup(deviceRegistry.add(rd.topic, rd))
+
+	w := httptest.NewRecorder()
+	handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status=%d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	pw := &pahoWrap{}
+
+	ready := func() (status int, report healthReport) {
+		w := httptest.NewRecorder()
+		readyHandler(pw)(w, httptest.NewRequest("GET", "/readyz", nil))
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return w.Code, report
+	}
+
+	if status, report := ready(); status != http.StatusServiceUnavailable || report.MQTT.OK {
+		t.Errorf("disconnected: status=%d report=%+v, want 503", status, report)
+	}
+
+	pw.connected.Store(true)
+	if status, _ := ready(); status != http.StatusOK {
+		t.Errorf("connected: status=%d, want 200", status)
+	}
+
+	rd := &registeredDevice{topic: "virt/device", state: &deviceState{}, started: time.Now(), staleAfter: time.Minute}
+	t.Cleanup(deviceRegistry.add(rd.topic, rd))
+	if status, report := ready(); status != http.StatusServiceUnavailable || len(report.Devices) != 1 || report.Devices[0].OK {
+		t.Errorf("device never succeeded: status=%d report=%+v, want 503", status, report)
+	}
+
+	rd.state.update(json.RawMessage(`{}`))
+	if status, _ := ready(); status != http.StatusOK {
+		t.Errorf("device succeeded: status=%d, want 200", status)
+	}
+
+	// a recovered state isn't from the handler, so doesn't count
+	recovered := &registeredDevice{topic: "virt/recovered", state: &deviceState{}, started: time.Now(), staleAfter: time.Minute}
+	recovered.state.recover(json.RawMessage(`{}`))
+	t.Cleanup(deviceRegistry.add(recovered.topic, recovered))
+	if status, _ := ready(); status != http.StatusServiceUnavailable {
+		t.Errorf("device recovered: status=%d, want 503", status)
+	}
+}
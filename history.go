@@ -4,75 +4,247 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"maps"
+	"math"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/eclipse/paho.golang/paho"
+	"github.com/samthor/gohaus/history"
 )
 
-type HistoryPacket struct {
-	Topic  string         `json:"-"`
-	When   int64          `json:"n"` // seconds
-	Packet map[string]any `json:"p"`
-}
-
 type HistoryReq struct {
 	Paho        *pahoWrap
 	Topic       string
 	MinDuration time.Duration
-	Ch          chan<- HistoryPacket
+	Queue       *historyQueue
 	GetKey      string
+	StaleAfter  time.Duration // if non-zero, how long without a packet before this is unhealthy
+
+	// Keys are flattened with history.Flatten, and then matched against these patterns (see path.Match).
+	StringKeys []string // string values are only recorded for matching keys
+	Include    []string // if non-empty, only matching keys are recorded
+	Exclude    []string // matching keys are not recorded
+
+	// Deadband, if non-empty, records a packet whenever a value changes by more than the deadband for its key, instead of every MinDuration.
+	// Its keys may be patterns, and the most specific match for each key is used, e.g., "*" is a default.
+	// Values without a matching deadband are still recorded, but changes to them don't cause a write.
+	Deadband    map[string]Deadband
+	MaxInterval time.Duration // with Deadband, write at least this often anyway, default 10*MinDuration
+	MinSpacing  time.Duration // with Deadband, write at most this often even if values change, default MinDuration/2
+}
+
+// Deadband is how much a value must change to be recorded.
+// A bool or string value, or a number whose deadband is zero, is recorded on any change.
+type Deadband struct {
+	Abs float64 `json:"abs"` // change by more than this
+	Pct float64 `json:"pct"` // change by more than this percentage of the last recorded value
+}
+
+// exceeded returns whether next differs from last by more than the deadband, which is the larger of Abs and Pct.
+func (d Deadband) exceeded(last, next any) bool {
+	lastF, ok1 := last.(float64)
+	nextF, ok2 := next.(float64)
+	if !ok1 || !ok2 {
+		return last != next
+	}
+	band := max(d.Abs, math.Abs(lastF)*d.Pct/100)
+	if band == 0 {
+		return lastF != nextF
+	}
+	return math.Abs(nextF-lastF) > band
+}
+
+// historySeries is the state of a concrete topic being recorded.
+type historySeries struct {
+	at   time.Time      // last written
+	last map[string]any // last written value of each key
+}
+
+// record notes that the packet was written at now.
+func (s *historySeries) record(packet map[string]any, now time.Time) {
+	s.at = now
+	if s.last == nil {
+		s.last = map[string]any{}
+	}
+	maps.Copy(s.last, packet) // merged, as devices may publish only some keys
+}
+
+// matchKey returns whether key matches any of the patterns, which are already validated.
+func matchKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// recordable returns whether the flattened key and its value should be recorded.
+func (req *HistoryReq) recordable(key string, value any) bool {
+	switch value.(type) {
+	case float64, bool:
+	case string:
+		if !matchKey(req.StringKeys, key) {
+			return false
+		}
+	default:
+		return false
+	}
+	if len(req.Include) != 0 && !matchKey(req.Include, key) {
+		return false
+	}
+	return !matchKey(req.Exclude, key)
+}
+
+// deadbandFor returns the deadband for the given key: an exact match, or else the longest matching pattern.
+func (req *HistoryReq) deadbandFor(key string) (d Deadband, ok bool) {
+	if d, ok := req.Deadband[key]; ok {
+		return d, true
+	}
+	var best string
+	for pattern := range req.Deadband {
+		if match, _ := path.Match(pattern, key); !match {
+			continue
+		}
+		if !ok || len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best, ok = pattern, true
+		}
+	}
+	return req.Deadband[best], ok
 }
 
-func History(req *HistoryReq) {
+// minSpacing returns the least time between writes, even if the deadband is exceeded.
+func (req *HistoryReq) minSpacing() time.Duration {
+	if len(req.Deadband) != 0 && req.MinSpacing > 0 {
+		return req.MinSpacing
+	}
+	return req.MinDuration / 2
+}
+
+// maxInterval returns the longest time between writes with a deadband.
+func (req *HistoryReq) maxInterval() time.Duration {
+	if req.MaxInterval > 0 {
+		return req.MaxInterval
+	}
+	return req.MinDuration * 10
+}
+
+// skip returns why the packet shouldn't be written to the series at now, or "" to write it.
+func (req *HistoryReq) skip(s *historySeries, packet map[string]any, now time.Time) (reason string) {
+	since := now.Sub(s.at)
+	if since < req.minSpacing() {
+		return "throttled" // without a deadband, ignore if <50% of MinDuration
+	} else if len(req.Deadband) == 0 {
+		return ""
+	}
+
+	if since >= req.maxInterval() {
+		return ""
+	}
+	for key, value := range packet {
+		if d, ok := req.deadbandFor(key); ok && d.exceeded(s.last[key], value) {
+			return ""
+		}
+	}
+	return "unchanged"
+}
+
+// idle returns whether the series can be forgotten at now, as a new series would record the next packet the same way.
+func (req *HistoryReq) idle(s *historySeries, now time.Time) bool {
+	since := now.Sub(s.at)
+	if len(req.Deadband) == 0 {
+		return since >= req.minSpacing()
+	}
+	return since >= req.maxInterval()
+}
+
+// History records packets sent to the given topic, and regularly asks for them via "/get".
+// The topic may contain MQTT wildcards, in which case each matching topic is recorded and throttled separately.
+// For wildcards, only the topics of matching devices are asked for, as other matching topics may not be devices at all, e.g., "zigbee2mqtt/bridge/...".
+// It stops when the passed context is cancelled, or via the returned stop func, after which no more packets are queued.
+func History(ctx context.Context, req *HistoryReq) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	logger := topicLogger(logHistory, req.Topic)
+	wildcard := strings.ContainsAny(req.Topic, "+#")
+
+	rh := &registeredHistory{topic: req.Topic, started: time.Now(), staleAfter: req.StaleAfter}
+	unregister := historyRegistry.add(req.Topic, rh)
+
 	var lock sync.Mutex
-	var lastWrite time.Time
+	series := map[string]*historySeries{} // by concrete topic, evicted once idle
 
+	// packetHandler runs on the MQTT router, which is fine as Queue never blocks
 	packetHandler := func(p *paho.Publish) {
 		now := time.Now()
 
 		lock.Lock()
 		defer lock.Unlock()
 
-		// create packet
-		out := HistoryPacket{Topic: req.Topic, When: now.Unix()}
-		err := json.Unmarshal(p.Payload, &out.Packet)
-		if err != nil {
-			log.Fatalf("couldn't decode mqtt packet: %v", err)
+		// a wildcard also matches requests to devices, including our own "/get"
+		if ctx.Err() != nil || (wildcard && isRequestTopic(p.Topic)) {
+			return
 		}
 
-		// delete non-aggregatable
-		for key, value := range out.Packet {
-			_, ok := value.(float64)
-			if ok {
-				continue
-			}
-			_, ok = value.(bool)
-			if ok {
-				continue
+		// create packet
+		var payload map[string]any
+		err := json.Unmarshal(p.Payload, &payload)
+		if err != nil {
+			if wildcard {
+				logger.Debug("couldn't decode packet", "match", p.Topic, "err", err) // likely not meant for history
+			} else {
+				logger.Warn("couldn't decode packet", "err", err)
 			}
-			delete(out.Packet, key)
+			metricHistoryDropped.add(1, req.Topic, "invalid") // by filter, as wildcards may match many other topics
+			return
 		}
+		rh.received(now)
+
+		out := history.Packet{Topic: p.Topic, When: now.Unix(), Packet: history.Flatten(payload)}
+		maps.DeleteFunc(out.Packet, func(key string, value any) bool { return !req.recordable(key, value) })
 
 		// filter (after log)
-		since := now.Sub(lastWrite)
-		if since < (req.MinDuration / 2) {
-			return // ignore if <50%
+		s := series[p.Topic]
+		if s == nil {
+			s = &historySeries{}
+			series[p.Topic] = s
+		}
+		if reason := req.skip(s, out.Packet, now); reason != "" {
+			metricHistoryDropped.add(1, req.Topic, reason)
+			return
 		}
 
-		lastWrite = now
-		req.Ch <- out
+		s.record(out.Packet, now)
+		hub.broadcast(event{Type: "history", Topic: p.Topic, At: time.Unix(out.When, 0), Data: out.Packet})
+		req.Queue.push(out)
 	}
 
-	req.Paho.router.RegisterHandler(req.Topic, func(p *paho.Publish) { go packetHandler(p) })
+	remove := req.Paho.handle(req.Topic, packetHandler)
 
-	if req.GetKey == "-" {
-		return // cannot request
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			lock.Lock()
+			cancel()
+			lock.Unlock()
+
+			remove()
+			unregister()
+		})
 	}
+	context.AfterFunc(ctx, func() { go stop() })
 
-	ctx := context.Background()
-	topicGet := fmt.Sprintf("%s/get", req.Topic) // TODO: what about + *
+	// evict idle series, so a wildcard over many short-lived topics doesn't grow forever
+	evict := func() {
+		now := time.Now()
+		lock.Lock()
+		defer lock.Unlock()
+		maps.DeleteFunc(series, func(topic string, s *historySeries) bool {
+			return req.idle(s, now)
+		})
+	}
 
 	sendPayload := []byte(`{}`)
 	if req.GetKey != "" {
@@ -81,19 +253,60 @@ func History(req *HistoryReq) {
 	}
 
 	send := func() {
-		_, err := req.Paho.c.Publish(ctx, &paho.Publish{
-			Topic:   topicGet,
-			Payload: sendPayload,
-		})
-		if err != nil {
-			log.Fatalf("could not send get: %v", err)
+		if req.GetKey == "-" {
+			return // cannot request
+		} else if !req.Paho.connected.Load() {
+			return // will be retried next tick
+		}
+
+		for _, topic := range getTopics(req.Topic) {
+			err := req.Paho.publish(&paho.Publish{
+				Topic:   fmt.Sprintf("%s/get", topic),
+				Payload: sendPayload,
+			})
+			if err != nil {
+				logger.Warn("could not send get", "match", topic, "err", err) // try again next tick
+			}
 		}
 	}
 
-	t := time.NewTicker(req.MinDuration)
 	go func() {
-		for range t.C {
-			send()
+		t := time.NewTicker(req.MinDuration)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				evict()
+				send()
+			}
 		}
 	}()
+
+	return stop
+}
+
+// getTopics returns the topics to send "/get" to for the history topic: itself, or for a wildcard, the matching registered devices.
+func getTopics(topic string) (out []string) {
+	if !strings.ContainsAny(topic, "+#") {
+		return []string{topic}
+	}
+	for _, rd := range deviceRegistry.all() {
+		if history.MatchTopic(topic, rd.topic) {
+			out = append(out, rd.topic)
+		}
+	}
+	return out
+}
+
+// isRequestTopic returns whether the topic is a request to a device or the result of one, rather than its state.
+func isRequestTopic(topic string) bool {
+	for _, suffix := range []string{"/get", "/set", "/set/result"} {
+		if strings.HasSuffix(topic, suffix) {
+			return true
+		}
+	}
+	return false
 }
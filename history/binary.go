@@ -0,0 +1,362 @@
+package history
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// The binary format starts with binaryMagic, followed by a stream of entries, each starting with a tag:
+//
+//   - binaryTagKey, uvarint length, bytes: adds a key to the file's dictionary, numbered from zero
+//   - binaryTagString, uvarint length, bytes: adds a string value to the file's dictionary of strings, numbered from zero
+//   - binaryTagPacket, varint seconds since the previous packet (or since zero), uvarint count, then that many values
+//
+// Each value is a uvarint key number, a kind byte, and a kind-specific payload:
+//
+//   - binaryFalse and binaryTrue have no payload
+//   - binaryIntDelta is a varint difference from the previous integer value for this key in the file (or from zero)
+//   - binaryFloat is 8 bytes of little-endian IEEE 754
+//   - binaryString is a uvarint string number, as strings are expected to be categorical, e.g., "cool" or "heat"
+//
+// Entries are appended as packets are written, so the file can be read back after a crash, losing at most a partial packet.
+// A stream may be followed by another starting with binaryMagic, which resets all state: see compressFile.
+const (
+	binaryMagic = "GHB1"
+
+	binaryTagKey    = 1
+	binaryTagPacket = 2
+	binaryTagString = 3
+
+	binaryFalse    = 0
+	binaryTrue     = 1
+	binaryIntDelta = 2
+	binaryFloat    = 3
+	binaryString   = 4
+)
+
+const (
+	maxExactInt     = 1 << 53 // the largest integer which float64 can represent exactly
+	maxBinaryLength = 1 << 20 // the longest key or string read, so a corrupt file can't allocate without bound
+)
+
+// binaryState is shared by the encoder and decoder, which must see the same entries.
+type binaryState struct {
+	keys        []string
+	keyIndex    map[string]uint64
+	strings     []string
+	stringIndex map[string]uint64
+	prevWhen    int64
+	prevInt     map[uint64]int64
+}
+
+func newBinaryState() binaryState {
+	return binaryState{keyIndex: map[string]uint64{}, stringIndex: map[string]uint64{}, prevInt: map[uint64]int64{}}
+}
+
+func (s *binaryState) addKey(key string) uint64 {
+	index := uint64(len(s.keys))
+	s.keys = append(s.keys, key)
+	s.keyIndex[key] = index
+	return index
+}
+
+func (s *binaryState) addString(v string) uint64 {
+	index := uint64(len(s.strings))
+	s.strings = append(s.strings, v)
+	s.stringIndex[v] = index
+	return index
+}
+
+type binaryEncoder struct {
+	binaryState
+	started bool // whether the magic has been written
+}
+
+func newBinaryEncoder() *binaryEncoder {
+	return &binaryEncoder{binaryState: newBinaryState()}
+}
+
+// restore reads an existing file to continue appending to it, returning the offset after its last complete packet.
+func (e *binaryEncoder) restore(f *os.File) (end int64, err error) {
+	d, end, err := decodeUntil(io.NewSectionReader(f, 0, math.MaxInt64))
+	if err != nil || d == nil {
+		return 0, err
+	}
+
+	// keys and strings after the last packet are about to be truncated, so must be forgotten too
+	if d.offset != end {
+		d, _, err = decodeUntil(io.NewSectionReader(f, 0, end))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d != nil {
+		e.binaryState = d.binaryState
+		e.started = true
+	}
+	return end, nil
+}
+
+// decodeUntil decodes r until its end or a partial entry, returning the decoder and the offset after its last complete packet.
+// The decoder is nil if r is empty.
+func decodeUntil(r io.Reader) (d *binaryDecoder, end int64, err error) {
+	d, err = newBinaryDecoder(bufio.NewReader(r))
+	if err == io.EOF {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		end = d.offset
+		_, err = d.decode()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return d, end, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+func (e *binaryEncoder) encode(p Packet) ([]byte, error) {
+	// check first, so that a bad packet doesn't change state
+	for key, value := range p.Packet {
+		switch value := value.(type) {
+		case bool, float64:
+		case string:
+			if len(value) > maxBinaryLength {
+				return nil, fmt.Errorf("can't encode key=%q, string too long", key)
+			}
+		default:
+			return nil, fmt.Errorf("can't encode key=%q of type %T", key, value)
+		}
+		if len(key) > maxBinaryLength {
+			return nil, fmt.Errorf("can't encode key, too long")
+		}
+	}
+
+	var b []byte
+	if !e.started {
+		b = append(b, binaryMagic...)
+		e.started = true
+	}
+
+	// add new keys and strings first, as a packet must refer to known ones
+	var values []byte
+	var count uint64
+	for key, value := range p.Packet {
+		index, ok := e.keyIndex[key]
+		if !ok {
+			index = e.addKey(key)
+			b = append(b, binaryTagKey)
+			b = binary.AppendUvarint(b, uint64(len(key)))
+			b = append(b, key...)
+		}
+
+		values = binary.AppendUvarint(values, index)
+		switch v := value.(type) {
+		case bool:
+			if v {
+				values = append(values, binaryTrue)
+			} else {
+				values = append(values, binaryFalse)
+			}
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) <= maxExactInt {
+				i := int64(v)
+				values = append(values, binaryIntDelta)
+				values = binary.AppendVarint(values, i-e.prevInt[index])
+				e.prevInt[index] = i
+			} else {
+				values = append(values, binaryFloat)
+				values = binary.LittleEndian.AppendUint64(values, math.Float64bits(v))
+			}
+		case string:
+			si, ok := e.stringIndex[v]
+			if !ok {
+				si = e.addString(v)
+				b = append(b, binaryTagString)
+				b = binary.AppendUvarint(b, uint64(len(v)))
+				b = append(b, v...)
+			}
+			values = append(values, binaryString)
+			values = binary.AppendUvarint(values, si)
+		}
+		count++
+	}
+
+	b = append(b, binaryTagPacket)
+	b = binary.AppendVarint(b, p.When-e.prevWhen)
+	b = binary.AppendUvarint(b, count)
+	b = append(b, values...)
+	e.prevWhen = p.When
+	return b, nil
+}
+
+type binaryDecoder struct {
+	binaryState
+	r      *bufio.Reader
+	offset int64 // bytes consumed by complete entries
+}
+
+// newBinaryDecoder checks the magic, returning io.EOF for an empty file.
+func newBinaryDecoder(r *bufio.Reader) (*binaryDecoder, error) {
+	magic := make([]byte, len(binaryMagic))
+	n, err := io.ReadFull(r, magic)
+	if string(magic[:n]) == binaryMagic[:n] && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return nil, io.EOF // empty, or crashed while writing the first packet
+	} else if err != nil || string(magic) != binaryMagic {
+		return nil, errBadMagic
+	}
+	return &binaryDecoder{binaryState: newBinaryState(), r: r, offset: int64(n)}, nil
+}
+
+// byteCounter counts bytes read through it.
+type byteCounter struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *byteCounter) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (c *byteCounter) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	got, err := io.ReadFull(c.r, b)
+	c.n += int64(got)
+	return b, err
+}
+
+// decode returns the next packet, or io.EOF at the end of the file.
+// A partial entry at the end of the file returns io.ErrUnexpectedEOF.
+func (d *binaryDecoder) decode() (p Packet, err error) {
+	for {
+		c := &byteCounter{r: d.r}
+		p, isPacket, err := d.decodeEntry(c)
+		if err == io.EOF && c.n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return Packet{}, err
+		}
+		d.offset += c.n
+		if isPacket {
+			return p, nil
+		}
+	}
+}
+
+func (d *binaryDecoder) decodeEntry(c *byteCounter) (p Packet, isPacket bool, err error) {
+	tag, err := c.ReadByte()
+	if err != nil {
+		return p, false, err
+	}
+
+	switch tag {
+	case binaryTagKey, binaryTagString:
+		length, err := binary.ReadUvarint(c)
+		if err != nil {
+			return p, false, err
+		} else if length > maxBinaryLength {
+			return p, false, fmt.Errorf("bad binary history length=%d", length)
+		}
+		b, err := c.read(int(length))
+		if err != nil {
+			return p, false, err
+		}
+		if tag == binaryTagKey {
+			d.addKey(string(b))
+		} else {
+			d.addString(string(b))
+		}
+		return p, false, nil
+
+	case binaryMagic[0]:
+		rest, err := c.read(len(binaryMagic) - 1)
+		if err != nil {
+			return p, false, err
+		} else if string(rest) != binaryMagic[1:] {
+			return p, false, errBadMagic
+		}
+		d.binaryState = newBinaryState()
+		return p, false, nil
+
+	case binaryTagPacket:
+	default:
+		return p, false, fmt.Errorf("bad binary history tag=%d", tag)
+	}
+
+	delta, err := binary.ReadVarint(c)
+	if err != nil {
+		return p, false, err
+	}
+	count, err := binary.ReadUvarint(c)
+	if err != nil {
+		return p, false, err
+	} else if count > uint64(len(d.keys)) {
+		return p, false, fmt.Errorf("bad binary history count=%d", count) // each key appears at most once
+	}
+
+	// don't change state until the whole packet is read
+	p = Packet{When: d.prevWhen + delta, Packet: make(map[string]any, count)}
+	ints := map[uint64]int64{}
+
+	for range count {
+		index, err := binary.ReadUvarint(c)
+		if err != nil {
+			return p, false, err
+		} else if index >= uint64(len(d.keys)) {
+			return p, false, fmt.Errorf("bad binary history key=%d", index)
+		}
+		key := d.keys[index]
+
+		kind, err := c.ReadByte()
+		if err != nil {
+			return p, false, err
+		}
+		switch kind {
+		case binaryFalse, binaryTrue:
+			p.Packet[key] = kind == binaryTrue
+		case binaryIntDelta:
+			delta, err := binary.ReadVarint(c)
+			if err != nil {
+				return p, false, err
+			}
+			i := d.prevInt[index] + delta
+			ints[index] = i
+			p.Packet[key] = float64(i)
+		case binaryFloat:
+			b, err := c.read(8)
+			if err != nil {
+				return p, false, err
+			}
+			p.Packet[key] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		case binaryString:
+			si, err := binary.ReadUvarint(c)
+			if err != nil {
+				return p, false, err
+			} else if si >= uint64(len(d.strings)) {
+				return p, false, fmt.Errorf("bad binary history string=%d", si)
+			}
+			p.Packet[key] = d.strings[si]
+		default:
+			return p, false, fmt.Errorf("bad binary history kind=%d", kind)
+		}
+	}
+
+	d.prevWhen = p.When
+	for index, i := range ints {
+		d.prevInt[index] = i
+	}
+	return p, true, nil
+}
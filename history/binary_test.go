@@ -0,0 +1,189 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var binaryTestPackets = []Packet{
+	{When: 1700000000, Packet: map[string]any{"temp": 21.5, "on": true}},
+	{When: 1700000010, Packet: map[string]any{"temp": 22.0, "mode": "cool"}},
+	{When: 1700000005, Packet: map[string]any{"mode": "heat", "count": -3.0}},
+	{When: 1700000100, Packet: map[string]any{}},
+	{When: 1700000200, Packet: map[string]any{"count": 1e15, "on": false, "mode": "cool", "big": 1e300}},
+}
+
+func encodeAll(t *testing.T, e *binaryEncoder, ps []Packet) (b []byte, ends []int) {
+	t.Helper()
+	for _, p := range ps {
+		chunk, err := e.encode(p)
+		if err != nil {
+			t.Fatalf("encode %+v: %v", p, err)
+		}
+		b = append(b, chunk...)
+		ends = append(ends, len(b))
+	}
+	return b, ends
+}
+
+func decodeAll(b []byte) (out []Packet, err error) {
+	d, err := newBinaryDecoder(bufio.NewReader(bytes.NewReader(b)))
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for {
+		p, err := d.decode()
+		if err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return out, err
+		}
+		out = append(out, p)
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []Packet
+	}{
+		{"empty", nil},
+		{"one", binaryTestPackets[:1]},
+		{"all", binaryTestPackets},
+		{"negative time", []Packet{{When: -5, Packet: map[string]any{"a": 1.0}}, {When: 10, Packet: map[string]any{"a": -1.0}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := encodeAll(t, newBinaryEncoder(), tt.packets)
+			got, err := decodeAll(b)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.packets) {
+				t.Errorf("got %+v, want %+v", got, tt.packets)
+			}
+		})
+	}
+}
+
+func TestBinaryConcatenated(t *testing.T) {
+	first, _ := encodeAll(t, newBinaryEncoder(), binaryTestPackets[:2])
+	second, _ := encodeAll(t, newBinaryEncoder(), binaryTestPackets[2:])
+
+	got, err := decodeAll(append(first, second...))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(got, binaryTestPackets) {
+		t.Errorf("got %+v, want %+v", got, binaryTestPackets)
+	}
+}
+
+func TestBinaryEncodeBadType(t *testing.T) {
+	e := newBinaryEncoder()
+	_, err := e.encode(Packet{When: 1, Packet: map[string]any{"a": 1.0, "b": []any{}}})
+	if err == nil {
+		t.Fatal("expected error for bad type")
+	}
+
+	// the failed packet must not have added keys
+	b, _ := encodeAll(t, e, binaryTestPackets[:1])
+	got, err := decodeAll(b)
+	if err != nil || !reflect.DeepEqual(got, binaryTestPackets[:1]) {
+		t.Errorf("got %+v, err=%v", got, err)
+	}
+}
+
+// TestBinaryRestoreTruncated truncates a file at every offset, as after a crash or failed write, and checks it can still be appended to.
+func TestBinaryRestoreTruncated(t *testing.T) {
+	full, ends := encodeAll(t, newBinaryEncoder(), binaryTestPackets)
+	extra := []Packet{
+		{When: 1700000300, Packet: map[string]any{"temp": 19.0, "mode": "dry", "new": true}},
+		{When: 1700000301, Packet: map[string]any{"count": 2.0, "mode": "cool"}},
+	}
+
+	dir := filepath.Join(t.TempDir(), "topic")
+	err := os.Mkdir(dir, 0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "2023-11-14.bin")
+
+	for offset := range len(full) + 1 {
+		err := os.WriteFile(path, full[:offset], 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, enc, err := openAppend(path, FormatBinary)
+		if err != nil {
+			t.Fatalf("offset=%d: openAppend: %v", offset, err)
+		}
+		for _, p := range extra {
+			b, err := enc.encode(p)
+			if err != nil {
+				t.Fatalf("offset=%d: encode: %v", offset, err)
+			}
+			_, err = f.Write(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		f.Close()
+
+		var want []Packet
+		for i, end := range ends {
+			if end <= offset {
+				want = append(want, binaryTestPackets[i])
+			}
+		}
+		want = append(want, extra...)
+		for i := range want {
+			want[i].Topic = "topic"
+		}
+
+		got, err := ReadFile(path)
+		if err != nil {
+			t.Fatalf("offset=%d: read: %v", offset, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("offset=%d: got %+v, want %+v", offset, got, want)
+		}
+	}
+}
+
+func TestBinaryCorrupt(t *testing.T) {
+	huge := binary.AppendUvarint(nil, 1<<62)
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"bad magic", []byte("nope")},
+		{"bad tag", []byte(binaryMagic + "\x09")},
+		{"huge key", append([]byte(binaryMagic+"\x01"), huge...)},
+		{"huge string", append([]byte(binaryMagic+"\x03"), huge...)},
+		{"huge count", append([]byte(binaryMagic+"\x02\x00"), huge...)},
+		{"unknown key", []byte(binaryMagic + "\x02\x00\x01\x00\x01")},
+		{"unknown string", []byte(binaryMagic + "\x01\x01a\x02\x00\x01\x00\x04\x00")},
+		{"bad kind", []byte(binaryMagic + "\x01\x01a\x02\x00\x01\x00\x09")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeAll(tt.b)
+			if err == nil || err == io.ErrUnexpectedEOF {
+				t.Errorf("expected corrupt error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package history
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Convert rewrites the history file at path into the given format, in the same directory, partitioned by day.
+// Packets are appended to any existing file for their day. The source file is not removed.
+// Uncompressed files are written, which a Writer compresses once their day is closed.
+func Convert(path string, to Format) (outputs []string, err error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	type output struct {
+		f   *os.File
+		enc encoder
+	}
+	open := map[string]*output{}
+	defer func() {
+		for _, o := range open {
+			err = errors.Join(err, o.f.Sync(), o.f.Close())
+		}
+	}()
+
+	dir := filepath.Dir(path)
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return outputs, err
+		}
+
+		target := filepath.Join(dir, time.Unix(p.When, 0).UTC().Format(dayFormat)+to.ext())
+		if target == path {
+			return outputs, errors.New("can't convert a file into itself")
+		}
+
+		o := open[target]
+		if o == nil {
+			f, enc, err := openAppend(target, to)
+			if err != nil {
+				return outputs, err
+			}
+			o = &output{f: f, enc: enc}
+			open[target] = o
+			outputs = append(outputs, target)
+		}
+
+		b, err := o.enc.encode(p)
+		if err != nil {
+			return outputs, err
+		}
+		_, err = o.f.Write(b)
+		if err != nil {
+			return outputs, err
+		}
+	}
+
+	slices.Sort(outputs)
+	return outputs, nil
+}
+
+// IsLegacy returns whether the file at path holds history from before it was partitioned by day.
+func IsLegacy(path string) bool {
+	return filepath.Base(path) == legacyName
+}
+
+// FileDay returns the UTC day of a day-partitioned history file, e.g., "2026-10-18".
+func FileDay(path string) (day string, ok bool) {
+	name := filepath.Base(path)
+	format, gzipped, ok := formatOf(name)
+	if !ok || len(name) < len(dayFormat) {
+		return "", false
+	}
+	day = name[:len(dayFormat)]
+	if _, err := time.Parse(dayFormat, day); err != nil {
+		return "", false
+	}
+
+	suffix := format.ext()
+	if gzipped {
+		suffix += gzipExt
+	}
+	return day, name == day+suffix
+}
+
+// FileFormat returns the format of the history file at path.
+func FileFormat(path string) (f Format, ok bool) {
+	f, _, ok = formatOf(filepath.Base(path))
+	return f, ok
+}
@@ -0,0 +1,63 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxEncodedTopic is the longest name most filesystems allow.
+const maxEncodedTopic = 255
+
+// EncodeTopic returns the directory name used to store history for the topic.
+// Levels are joined with '_'. Anything other than ASCII letters, digits, ' ', '-' and '.' (but not a leading '.') is written as "%XX" for each byte, including '_' and '%' themselves.
+// Topics only using '/' and the allowed characters are therefore stored as they always have been.
+func EncodeTopic(t string) (out string, err error) {
+	if t == "" {
+		return "", errors.New("can't encode empty topic")
+	}
+
+	var b strings.Builder
+	for i := range len(t) {
+		c := t[i]
+		switch {
+		case c == '/':
+			b.WriteByte('_')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ' ', c == '-', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	out = b.String()
+	if len(out) > maxEncodedTopic {
+		return "", fmt.Errorf("topic is too long to encode: %q", t)
+	}
+	return out, nil
+}
+
+// DecodeTopic reverses EncodeTopic.
+func DecodeTopic(enc string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(enc); i++ {
+		switch c := enc[i]; c {
+		case '_':
+			b.WriteByte('/')
+		case '%':
+			if i+2 >= len(enc) {
+				return "", fmt.Errorf("bad encoded topic: %q", enc)
+			}
+			v, err := strconv.ParseUint(enc[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("bad encoded topic: %q", enc)
+			}
+			b.WriteByte(byte(v))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
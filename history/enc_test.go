@@ -0,0 +1,56 @@
+package history
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{"virt/powerwall", "virt_powerwall"},
+		{"zigbee2mqtt/device/sensor/noc-etc", "zigbee2mqtt_device_sensor_noc-etc"},
+		{"a b.c", "a b.c"},
+		{"snake_case", "snake%5Fcase"},
+		{"100%", "100%25"},
+		{".hidden/x", "%2Ehidden_x"},
+		{"/leading", "_leading"},
+		{"café", "caf%C3%A9"},
+		{"a+b#c", "a%2Bb%23c"},
+	}
+
+	for _, tt := range tests {
+		got, err := EncodeTopic(tt.topic)
+		if err != nil {
+			t.Errorf("EncodeTopic(%q): %v", tt.topic, err)
+			continue
+		} else if got != tt.want {
+			t.Errorf("EncodeTopic(%q) = %q, want %q", tt.topic, got, tt.want)
+		}
+
+		back, err := DecodeTopic(got)
+		if err != nil || back != tt.topic {
+			t.Errorf("DecodeTopic(%q) = %q, %v, want %q", got, back, err, tt.topic)
+		}
+	}
+}
+
+func TestEncodeTopicInvalid(t *testing.T) {
+	for _, topic := range []string{"", strings.Repeat("a", maxEncodedTopic+1), strings.Repeat("_", maxEncodedTopic/3+1)} {
+		_, err := EncodeTopic(topic)
+		if err == nil {
+			t.Errorf("EncodeTopic(%q): expected error", topic)
+		}
+	}
+}
+
+func TestDecodeTopicInvalid(t *testing.T) {
+	for _, enc := range []string{"%", "a%4", "%zz", "%4g"} {
+		_, err := DecodeTopic(enc)
+		if err == nil {
+			t.Errorf("DecodeTopic(%q): expected error", enc)
+		}
+	}
+}
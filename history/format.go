@@ -0,0 +1,195 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Format is an on-disk format for history.
+type Format string
+
+const (
+	FormatJSONL  Format = "jsonl" // a JSON-encoded Packet per line
+	FormatBinary Format = "bin"   // see binaryEncoder
+)
+
+// ext returns the file extension for the format, including the ".".
+func (f Format) ext() string {
+	return "." + string(f)
+}
+
+func (f Format) valid() bool {
+	return f == FormatJSONL || f == FormatBinary
+}
+
+// ParseFormat returns the format with the given name, or FormatJSONL if empty.
+func ParseFormat(s string) (Format, error) {
+	if s == "" {
+		return FormatJSONL, nil
+	}
+	f := Format(s)
+	if !f.valid() {
+		return "", fmt.Errorf("unknown history format %q, must be %q or %q", s, FormatJSONL, FormatBinary)
+	}
+	return f, nil
+}
+
+// formatOf returns the format and whether the file is gzipped, based on its name.
+func formatOf(name string) (f Format, gzipped, ok bool) {
+	name, gzipped = strings.CutSuffix(name, gzipExt)
+	for _, f := range []Format{FormatJSONL, FormatBinary} {
+		if strings.HasSuffix(name, f.ext()) {
+			return f, gzipped, true
+		}
+	}
+	return "", false, false
+}
+
+// encoder encodes packets to append to a file.
+type encoder interface {
+	encode(p Packet) ([]byte, error)
+}
+
+type jsonlEncoder struct{}
+
+func (jsonlEncoder) encode(p Packet) ([]byte, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// decoder reads packets from a file, returning io.EOF at its end.
+type decoder interface {
+	decode() (Packet, error)
+}
+
+type jsonlDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *jsonlDecoder) decode() (p Packet, err error) {
+	for {
+		line, err := d.r.ReadBytes('\n')
+		if len(line) == 0 || (err != nil && err != io.EOF) {
+			return p, err
+		} else if err == io.EOF {
+			return p, io.ErrUnexpectedEOF // partial last line
+		}
+
+		if strings.TrimSpace(string(line)) == "" {
+			continue
+		}
+		err = json.Unmarshal(line, &p)
+		return p, err
+	}
+}
+
+func newDecoder(f Format, r *bufio.Reader) (decoder, error) {
+	switch f {
+	case FormatJSONL:
+		return &jsonlDecoder{r: r}, nil
+	case FormatBinary:
+		return newBinaryDecoder(r)
+	}
+	return nil, fmt.Errorf("unknown history format %q", f)
+}
+
+// openAppend opens the uncompressed file at path for appending packets in the given format.
+// Any partially written packet at the end of an existing file is removed, and for the binary format, the file is read to restore the encoder's state.
+func openAppend(path string, f Format) (_ *os.File, _ encoder, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+		}
+	}()
+
+	var enc encoder = jsonlEncoder{}
+	var end int64
+	if f == FormatBinary {
+		be := newBinaryEncoder()
+		end, err = be.restore(file)
+		enc = be
+	} else {
+		end, err = jsonlEnd(file)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't read %s: %w", path, err)
+	}
+	err = file.Truncate(end)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, enc, nil
+}
+
+// jsonlEnd returns the offset after the last complete line of the file.
+func jsonlEnd(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 4096)
+	for end := info.Size(); end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i != -1 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// jsonlLastWhen returns the time of the last complete packet in the JSONL file at path, reading only its end.
+// This returns false if that can't be found, e.g., the last line is very long.
+func jsonlLastWhen(path string) (when int64, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	end, err := jsonlEnd(f)
+	if err != nil || end == 0 {
+		return 0, false
+	}
+	buf := make([]byte, min(end, 64*1024))
+	_, err = f.ReadAt(buf, end-int64(len(buf)))
+	if err != nil {
+		return 0, false
+	}
+
+	line := buf[:len(buf)-1] // trailing '\n'
+	i := bytes.LastIndexByte(line, '\n')
+	if i == -1 && int64(len(buf)) < end {
+		return 0, false // line starts before buf
+	}
+	var p Packet
+	if json.Unmarshal(line[i+1:], &p) != nil {
+		return 0, false
+	}
+	return p.When, true
+}
+
+var errBadMagic = errors.New("not a binary history file")
@@ -0,0 +1,35 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestJSONLRestoreTruncated checks a partially written line is removed before appending, as after a crash or failed write.
+func TestJSONLRestoreTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "2023-11-14.jsonl")
+	full := `{"n":1,"p":{"a":1}}` + "\n" + `{"n":2,"p":{"a":2}}` + "\n"
+
+	for offset := range len(full) + 1 {
+		err := os.WriteFile(path, []byte(full[:offset]), 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, enc, err := openAppend(path, FormatJSONL)
+		if err != nil {
+			t.Fatalf("offset=%d: openAppend: %v", offset, err)
+		}
+		b, _ := enc.encode(Packet{When: 3, Packet: map[string]any{"a": 3.0}})
+		f.Write(b)
+		f.Close()
+
+		got, _ := os.ReadFile(path)
+		want := full[:strings.LastIndexByte(full[:offset], '\n')+1] + string(b)
+		if string(got) != want {
+			t.Fatalf("offset=%d: got %q, want %q", offset, got, want)
+		}
+	}
+}
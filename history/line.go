@@ -0,0 +1,53 @@
+package history
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	lineMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	lineKeyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	lineStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`)
+)
+
+// AppendLine appends the packet in InfluxDB line protocol to b, as the given measurement tagged with its topic, with a nanosecond timestamp.
+// Numbers are always written as floats, so a key's type is consistent. Packets with no values are skipped, as a line needs at least one field.
+func AppendLine(b []byte, measurement string, p Packet) []byte {
+	keys := slices.Sorted(maps.Keys(p.Packet))
+	if len(keys) == 0 {
+		return b
+	}
+
+	b = append(b, lineMeasurementEscaper.Replace(measurement)...)
+	b = append(b, ",topic="...)
+	b = append(b, lineKeyEscaper.Replace(p.Topic)...)
+
+	for i, key := range keys {
+		if i == 0 {
+			b = append(b, ' ')
+		} else {
+			b = append(b, ',')
+		}
+		b = append(b, lineKeyEscaper.Replace(key)...)
+		b = append(b, '=')
+
+		switch v := p.Packet[key].(type) {
+		case float64:
+			b = strconv.AppendFloat(b, v, 'f', -1, 64)
+		case bool:
+			b = strconv.AppendBool(b, v)
+		default:
+			b = append(b, '"')
+			b = append(b, lineStringEscaper.Replace(fmt.Sprint(v))...)
+			b = append(b, '"')
+		}
+	}
+
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, p.When*1e9, 10)
+	return append(b, '\n')
+}
@@ -0,0 +1,31 @@
+package history
+
+import "testing"
+
+func TestAppendLine(t *testing.T) {
+	tests := []struct {
+		name        string
+		measurement string
+		p           Packet
+		want        string
+	}{
+		{"empty", "m", Packet{Topic: "a", When: 1, Packet: map[string]any{}}, ""},
+		{
+			"types", "m",
+			Packet{Topic: "virt/den", When: 1700000000, Packet: map[string]any{"temp": 21.5, "on": true, "mode": "cool", "count": 3.0}},
+			`m,topic=virt/den count=3,mode="cool",on=true,temp=21.5 1700000000000000000` + "\n",
+		},
+		{
+			"escaped", "my m,x",
+			Packet{Topic: "a b,c=d", When: 1, Packet: map[string]any{"k=1 2": `say "hi"\`}},
+			`my\ m\,x,topic=a\ b\,c\=d k\=1\ 2="say \"hi\"\\" 1000000000` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		got := string(AppendLine(nil, tt.measurement, tt.p))
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
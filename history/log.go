@@ -0,0 +1,15 @@
+package history
+
+import (
+	"log/slog"
+)
+
+// Logger is used to log by this package, or slog.Default if nil.
+var Logger *slog.Logger
+
+func logger() *slog.Logger {
+	if Logger != nil {
+		return Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,40 @@
+package history
+
+import (
+	"strings"
+)
+
+// MatchTopic reports whether the MQTT topic filter, which may contain "+" and "#" wildcards, matches topic.
+// Like MQTT, "a/#" also matches "a".
+func MatchTopic(filter, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+
+	for i, f := range filterParts {
+		if f == "#" {
+			return true
+		} else if i >= len(topicParts) {
+			return false
+		} else if f != "+" && f != topicParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+// ValidTopicFilter reports whether filter is a valid MQTT topic filter: wildcards must be a whole level, and "#" must be last.
+func ValidTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	parts := strings.Split(filter, "/")
+	for i, part := range parts {
+		if part == "#" && i == len(parts)-1 {
+			continue
+		}
+		if part != "+" && strings.ContainsAny(part, "+#") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package history
+
+import (
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "anything/at/all", true},
+		{"+/b", "a/b", true},
+		{"+", "", true},
+	}
+
+	for _, tt := range tests {
+		if got := MatchTopic(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"a/b", true},
+		{"a/+/c", true},
+		{"a/#", true},
+		{"#", true},
+		{"", false},
+		{"a/#/c", false},
+		{"a/b+", false},
+		{"a#", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidTopicFilter(tt.filter); got != tt.want {
+			t.Errorf("ValidTopicFilter(%q) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
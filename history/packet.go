@@ -0,0 +1,96 @@
+package history
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Packet is a single recorded message on a topic.
+// Its values are float64, bool or string, keyed by their flattened path (see Flatten).
+type Packet struct {
+	Topic  string         `json:"-"`
+	When   int64          `json:"n"` // seconds
+	Packet map[string]any `json:"p"`
+}
+
+// Flatten flattens nested objects and arrays in v into dotted keys, e.g., {"a":{"b":1},"c":[true]} becomes {"a.b":1,"c.0":true}.
+// Empty objects and arrays, and nulls, are dropped.
+func Flatten(v map[string]any) map[string]any {
+	out := make(map[string]any, len(v))
+	flattenInto(out, "", v)
+	return out
+}
+
+func flattenInto(out map[string]any, prefix string, v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, each := range v {
+			flattenInto(out, prefix+key+".", each)
+		}
+	case []any:
+		for i, each := range v {
+			flattenInto(out, prefix+strconv.Itoa(i)+".", each)
+		}
+	case nil:
+	default:
+		out[strings.TrimSuffix(prefix, ".")] = v
+	}
+}
+
+// Unflatten reverses Flatten as best it can: objects whose keys are exactly "0" to "n-1" become arrays.
+// A key which conflicts with another, e.g., "a.b" alongside "a", is kept as-is.
+func Unflatten(flat map[string]any) map[string]any {
+	out := map[string]any{}
+
+	// sorted, so a parent is seen before its children
+	for _, key := range slices.Sorted(maps.Keys(flat)) {
+		parts := strings.Split(key, ".")
+		m := out
+		for _, part := range parts[:len(parts)-1] {
+			if m[part] == nil {
+				m[part] = map[string]any{}
+			}
+			next, ok := m[part].(map[string]any)
+			if !ok {
+				m = nil
+				break
+			}
+			m = next
+		}
+
+		last := parts[len(parts)-1]
+		if _, exists := m[last]; m != nil && !exists {
+			m[last] = flat[key]
+		} else {
+			out[key] = flat[key]
+		}
+	}
+
+	for key, v := range out {
+		out[key] = toArrays(v)
+	}
+	return out
+}
+
+// toArrays converts nested objects which look like flattened arrays back to arrays.
+func toArrays(v any) any {
+	m, ok := v.(map[string]any)
+	if !ok || len(m) == 0 {
+		return v
+	}
+	for key, each := range m {
+		m[key] = toArrays(each)
+	}
+
+	arr := make([]any, len(m))
+	for i := range arr {
+		each, ok := m[strconv.Itoa(i)]
+		if !ok {
+			return m
+		}
+		arr[i] = each
+	}
+	return arr
+}
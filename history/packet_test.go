@@ -0,0 +1,64 @@
+package history
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	tests := []struct {
+		name string
+		in   map[string]any
+		want map[string]any
+	}{
+		{"flat", map[string]any{"a": 1.0, "b": true, "c": "x"}, map[string]any{"a": 1.0, "b": true, "c": "x"}},
+		{"nested", map[string]any{"a": map[string]any{"b": 1.0, "c": map[string]any{"d": "x"}}}, map[string]any{"a.b": 1.0, "a.c.d": "x"}},
+		{"array", map[string]any{"c": []any{true, 2.0}}, map[string]any{"c.0": true, "c.1": 2.0}},
+		{"array of objects", map[string]any{"c": []any{map[string]any{"x": 1.0}}}, map[string]any{"c.0.x": 1.0}},
+		{"dropped", map[string]any{"n": nil, "e": map[string]any{}, "a": []any{}}, map[string]any{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Flatten(tt.in)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnflatten(t *testing.T) {
+	tests := []struct {
+		name string
+		in   map[string]any
+		want map[string]any
+	}{
+		{"flat", map[string]any{"a": 1.0}, map[string]any{"a": 1.0}},
+		{"nested", map[string]any{"a.b": 1.0, "a.c.d": "x"}, map[string]any{"a": map[string]any{"b": 1.0, "c": map[string]any{"d": "x"}}}},
+		{"array", map[string]any{"c.0": true, "c.1": 2.0}, map[string]any{"c": []any{true, 2.0}}},
+		{"sparse array", map[string]any{"c.0": true, "c.2": 2.0}, map[string]any{"c": map[string]any{"0": true, "2": 2.0}}},
+		{"conflict", map[string]any{"a": 1.0, "a.b": 2.0}, map[string]any{"a": 1.0, "a.b": 2.0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Unflatten(tt.in)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlattenRoundTrip(t *testing.T) {
+	in := map[string]any{
+		"update": map[string]any{"state": "idle", "progress": 50.0},
+		"color":  map[string]any{"xy": []any{0.3, 0.4}},
+		"on":     true,
+	}
+	got := Unflatten(Flatten(in))
+	if !reflect.DeepEqual(got, in) {
+		t.Errorf("got %v, want %v", got, in)
+	}
+}
@@ -0,0 +1,294 @@
+package history
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Query describes aggregated series to read back from history.
+type Query struct {
+	Topic  string
+	Keys   []string // if empty, every numeric or bool key
+	From   time.Time
+	To     time.Time
+	Bucket time.Duration // if zero, a single bucket covering From to To
+}
+
+// Bucket aggregates the samples of a key within [Start,Start+Bucket) of a Query.
+// Bools are treated as 0 or 1.
+// Min, Max, Mean and Last are nil if there were no samples within the bucket.
+type Bucket struct {
+	Start int64    `json:"t"`
+	Count int      `json:"n"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Mean  *float64 `json:"mean,omitempty"`
+	Last  *float64 `json:"last,omitempty"`
+
+	// TimeMean is the mean weighted by how long each value was held, assuming a value holds until the next sample.
+	// This includes a value carried in from before the bucket, so may be set even if there were no samples.
+	// This is the right mean for values like power, where samples are irregular.
+	TimeMean *float64 `json:"timeMean,omitempty"`
+}
+
+// Series is the buckets for a single key, in order.
+// Buckets which have no samples and no value carried in are omitted.
+type Series struct {
+	Key     string   `json:"key"`
+	Buckets []Bucket `json:"buckets"`
+}
+
+// ParseTime parses RFC 3339 or unix seconds, as accepted for a Query from users.
+func ParseTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// maxBuckets bounds the work done by a single Query.
+const maxBuckets = 100_000
+
+// ErrBadQuery wraps errors from Query.Run caused by the query itself, rather than reading history.
+var ErrBadQuery = errors.New("bad query")
+
+// Run runs the query against the history under dir, as written by Writer.
+// Returns fs.ErrNotExist if there's no history for the topic, or an error wrapping ErrBadQuery if the query is invalid.
+func (q Query) Run(dir string) (out []Series, err error) {
+	if !q.To.After(q.From) {
+		return nil, fmt.Errorf("%w: must end after it starts", ErrBadQuery)
+	}
+	from, to := q.From.Unix(), q.To.Unix()
+	bucket := int64(q.Bucket / time.Second)
+	if q.Bucket == 0 {
+		bucket = to - from
+	} else if bucket <= 0 {
+		return nil, fmt.Errorf("%w: bucket must be at least 1s, was %v", ErrBadQuery, q.Bucket)
+	} else if (to-from)/bucket >= maxBuckets {
+		return nil, fmt.Errorf("%w: too many buckets, max %d", ErrBadQuery, maxBuckets)
+	}
+
+	enc, err := EncodeTopic(q.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadQuery, err)
+	}
+	paths, err := queryFiles(filepath.Join(dir, enc), q.From, q.To)
+	if err != nil {
+		return nil, err
+	}
+
+	aggs := map[string]*aggregator{}
+	want := func(key string) bool {
+		return len(q.Keys) == 0 || slices.Contains(q.Keys, key)
+	}
+
+	// files may overlap (legacy, or the same day in two formats), so gather then sort
+	var packets []Packet
+	for _, path := range paths {
+		all, err := ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range all {
+			if p.When < to {
+				packets = append(packets, p)
+			}
+		}
+	}
+	slices.SortStableFunc(packets, func(a, b Packet) int {
+		return cmp.Compare(a.When, b.When)
+	})
+
+	for _, p := range packets {
+		for key, raw := range p.Packet {
+			v, ok := numeric(raw)
+			if !ok || !want(key) {
+				continue
+			}
+			a := aggs[key]
+			if a == nil {
+				a = &aggregator{from: from, to: to, bucket: bucket}
+				aggs[key] = a
+			}
+			a.add(p.When, v)
+		}
+	}
+
+	keys := q.Keys
+	if len(keys) == 0 {
+		for key := range aggs {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+	}
+	for _, key := range keys {
+		s := Series{Key: key, Buckets: []Bucket{}}
+		if a := aggs[key]; a != nil {
+			s.Buckets = a.finish()
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// queryFiles returns the files within the topic's directory which may hold packets from the given range.
+// This includes the day before, to find the value held at the start of the range.
+// A legacy file isn't partitioned by day, so is read in full unless its last packet is before then.
+func queryFiles(topicDir string, from, to time.Time) (out []string, err error) {
+	files, err := os.ReadDir(topicDir)
+	if err != nil {
+		return nil, err
+	}
+	first := from.UTC().AddDate(0, 0, -1).Format(dayFormat)
+	last := to.UTC().Format(dayFormat)
+
+	for _, f := range files {
+		path := filepath.Join(topicDir, f.Name())
+		if !f.Type().IsRegular() {
+			continue
+		} else if IsLegacy(path) {
+			when, ok := jsonlLastWhen(path)
+			if !ok || time.Unix(when, 0).UTC().Format(dayFormat) >= first {
+				out = append(out, path)
+			}
+		} else if day, ok := FileDay(path); ok && day >= first && day <= last {
+			out = append(out, path)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return out, nil
+}
+
+func numeric(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// aggregator builds buckets from samples added in time order.
+type aggregator struct {
+	from, to, bucket int64
+
+	buckets []Bucket
+	cur     *Bucket
+	sum     float64 // of values in cur
+
+	// the held value and since when, for TimeMean
+	held      float64
+	heldSince int64
+	hasHeld   bool
+	weighted  float64 // of value*seconds in cur
+	covered   int64   // seconds in cur with a held value
+}
+
+func (a *aggregator) add(when int64, v float64) {
+	if when < a.from {
+		a.held, a.heldSince, a.hasHeld = v, a.from, true
+		return
+	}
+	a.advance(when)
+
+	c := a.cur
+	if c.Count == 0 {
+		c.Min, c.Max = ptr(v), ptr(v)
+	} else {
+		c.Min, c.Max = ptr(math.Min(*c.Min, v)), ptr(math.Max(*c.Max, v))
+	}
+	c.Count++
+	c.Last = ptr(v)
+	a.sum += v
+
+	a.accumulate(when)
+	a.held, a.heldSince, a.hasHeld = v, when, true
+}
+
+// advance closes buckets until when falls within the current bucket.
+func (a *aggregator) advance(when int64) {
+	start := a.from + (when-a.from)/a.bucket*a.bucket
+
+	for a.cur == nil || a.cur.Start != start {
+		if a.cur != nil {
+			a.close(a.cur.Start + a.bucket)
+		}
+
+		// buckets in between have a held value, so must be visited
+		next := start
+		if a.hasHeld && a.cur != nil {
+			next = a.cur.Start + a.bucket
+		} else if a.hasHeld {
+			next = a.from
+		}
+		a.cur = &Bucket{Start: next}
+		a.sum, a.weighted, a.covered = 0, 0, 0
+		if a.hasHeld {
+			a.heldSince = next
+		}
+	}
+}
+
+// close accumulates the held value until end, and appends the current bucket if it has anything to report.
+func (a *aggregator) close(end int64) {
+	c := a.cur
+	a.accumulate(end)
+	if a.covered > 0 {
+		c.TimeMean = ptr(a.weighted / float64(a.covered))
+	}
+	if c.Count > 0 {
+		c.Mean = ptr(a.sum / float64(c.Count))
+	}
+	if c.Count > 0 || c.TimeMean != nil {
+		a.buckets = append(a.buckets, *c)
+	}
+}
+
+// finish closes the final bucket, holding the last value until the end of the query, or now if sooner.
+func (a *aggregator) finish() []Bucket {
+	end := min(a.to, time.Now().Unix())
+	if a.cur == nil && !a.hasHeld {
+		return []Bucket{}
+	}
+	if a.cur == nil {
+		a.advance(a.from)
+	}
+	for {
+		bucketEnd := min(a.cur.Start+a.bucket, a.to)
+		if bucketEnd >= end {
+			a.close(end)
+			break
+		}
+		a.close(bucketEnd)
+		a.cur = &Bucket{Start: bucketEnd}
+		a.sum, a.weighted, a.covered = 0, 0, 0
+	}
+	return a.buckets
+}
+
+// accumulate weights the held value until the given time.
+func (a *aggregator) accumulate(until int64) {
+	if a.hasHeld && until > a.heldSince {
+		a.weighted += a.held * float64(until-a.heldSince)
+		a.covered += until - a.heldSince
+		a.heldSince = until
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
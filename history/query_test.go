@@ -0,0 +1,190 @@
+package history
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type sample struct {
+	when int64
+	v    float64
+}
+
+func TestAggregator(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int64
+		bucket   int64
+		samples  []sample
+		want     []Bucket
+	}{
+		{
+			name: "empty",
+			from: 0, to: 100, bucket: 100,
+			want: []Bucket{},
+		},
+		{
+			name: "single bucket",
+			from: 0, to: 100, bucket: 100,
+			samples: []sample{{0, 10}, {50, 20}, {75, 0}},
+			want: []Bucket{
+				{Start: 0, Count: 3, Min: ptr(0), Max: ptr(20), Mean: ptr(10), Last: ptr(0), TimeMean: ptr((10*50 + 20*25 + 0*25) / 100.0)},
+			},
+		},
+		{
+			name: "carried in",
+			from: 100, to: 200, bucket: 50,
+			samples: []sample{{20, 4}, {150, 8}},
+			want: []Bucket{
+				{Start: 100, TimeMean: ptr(4)},
+				{Start: 150, Count: 1, Min: ptr(8), Max: ptr(8), Mean: ptr(8), Last: ptr(8), TimeMean: ptr(8)},
+			},
+		},
+		{
+			name: "held across empty buckets",
+			from: 0, to: 40, bucket: 10,
+			samples: []sample{{5, 2}, {35, 6}},
+			want: []Bucket{
+				{Start: 0, Count: 1, Min: ptr(2), Max: ptr(2), Mean: ptr(2), Last: ptr(2), TimeMean: ptr(2)},
+				{Start: 10, TimeMean: ptr(2)},
+				{Start: 20, TimeMean: ptr(2)},
+				{Start: 30, Count: 1, Min: ptr(6), Max: ptr(6), Mean: ptr(6), Last: ptr(6), TimeMean: ptr((2*5 + 6*5) / 10.0)},
+			},
+		},
+		{
+			name: "partial final bucket",
+			from: 0, to: 25, bucket: 10,
+			samples: []sample{{0, 1}},
+			want: []Bucket{
+				{Start: 0, Count: 1, Min: ptr(1), Max: ptr(1), Mean: ptr(1), Last: ptr(1), TimeMean: ptr(1)},
+				{Start: 10, TimeMean: ptr(1)},
+				{Start: 20, TimeMean: ptr(1)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &aggregator{from: tt.from, to: tt.to, bucket: tt.bucket}
+			for _, s := range tt.samples {
+				a.add(s.when, s.v)
+			}
+			got := a.finish()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %s, want %s", formatBuckets(got), formatBuckets(tt.want))
+			}
+		})
+	}
+}
+
+func formatBuckets(bs []Bucket) (out []map[string]any) {
+	for _, b := range bs {
+		m := map[string]any{"t": b.Start, "n": b.Count}
+		for name, v := range map[string]*float64{"min": b.Min, "max": b.Max, "mean": b.Mean, "last": b.Last, "timeMean": b.TimeMean} {
+			if v != nil {
+				m[name] = *v
+			}
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestQueryRun(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(WriterOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	for _, p := range []Packet{
+		{When: day.Add(-time.Hour).Unix(), Packet: map[string]any{"power": 100.0}},
+		{When: day.Add(time.Hour).Unix(), Packet: map[string]any{"power": 300.0, "on": true, "mode": "cool"}},
+	} {
+		p.Topic = "a/b"
+		err := w.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	q := Query{Topic: "a/b", From: day, To: day.Add(time.Hour * 2)}
+	got, err := q.Run(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Key != "on" || got[1].Key != "power" {
+		t.Fatalf("got %+v", got)
+	}
+	power := got[1].Buckets
+	if len(power) != 1 || power[0].Count != 1 || *power[0].TimeMean != 200 {
+		t.Errorf("got power %s", formatBuckets(power))
+	}
+
+	_, err = Query{Topic: "missing", From: day, To: day.Add(time.Hour)}.Run(dir)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	for _, q := range []Query{
+		{Topic: "a/b", From: day, To: day},
+		{Topic: "a/b", From: day, To: day.Add(time.Hour), Bucket: time.Millisecond},
+		{Topic: "a/b", From: day, To: day.Add(time.Hour * 24 * 365), Bucket: time.Second},
+	} {
+		_, err := q.Run(dir)
+		if !errors.Is(err, ErrBadQuery) {
+			t.Errorf("query %+v: expected ErrBadQuery, got %v", q, err)
+		}
+	}
+}
+
+func TestQueryFilesLegacy(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, legacyName)
+	err := os.WriteFile(legacy, []byte(`{"n":1000,"p":{"a":1}}`+"\n"+`{"n":86400,"p":{"a":2}}`+"\n"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		from time.Time
+		want bool
+	}{
+		{time.Unix(0, 0), true},
+		{time.Unix(86400*2, 0), true}, // the day before is included for its held value
+		{time.Unix(86400*3, 0), false},
+	}
+	for _, tt := range tests {
+		paths, err := queryFiles(dir, tt.from, tt.from.Add(time.Hour))
+		got := err == nil && len(paths) == 1
+		if got != tt.want {
+			t.Errorf("from=%v: got paths=%v err=%v, want included=%v", tt.from, paths, err, tt.want)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{"1700000000", 1700000000, false},
+		{"2023-11-14T22:13:20Z", 1700000000, false},
+		{"2023-11-15T09:13:20+11:00", 1700000000, false},
+		{"yesterday", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTime(tt.s)
+		if (err != nil) != tt.wantErr || (err == nil && got.Unix() != tt.want) {
+			t.Errorf("ParseTime(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
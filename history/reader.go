@@ -0,0 +1,148 @@
+package history
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reader reads packets back from a history file in any format, compressed or not.
+type Reader struct {
+	f     *os.File
+	gz    *gzip.Reader
+	dec   decoder
+	topic string
+}
+
+// Open opens the history file at path, which must be within a topic's directory, or be unmigrated (see IsUnmigrated).
+func Open(path string) (*Reader, error) {
+	format, gzipped, ok := formatOf(filepath.Base(path))
+	if !ok {
+		format = FormatJSONL // unmigrated
+	}
+
+	topic, err := FileTopic(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{f: f, topic: topic}
+
+	var src io.Reader = f
+	if gzipped {
+		r.gz, err = gzip.NewReader(f)
+		if err == io.EOF {
+			r.dec = emptyDecoder{}
+			return r, nil
+		} else if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		src = r.gz
+	}
+
+	r.dec, err = newDecoder(format, bufio.NewReader(src))
+	if err == io.EOF {
+		r.dec = emptyDecoder{}
+	} else if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+type emptyDecoder struct{}
+
+func (emptyDecoder) decode() (Packet, error) {
+	return Packet{}, io.EOF
+}
+
+// Next returns the next packet, or io.EOF after the last.
+// A partially written packet at the end of the file, e.g., after a crash, is ignored.
+func (r *Reader) Next() (p Packet, err error) {
+	p, err = r.dec.decode()
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	p.Topic = r.topic
+	return p, err
+}
+
+func (r *Reader) Close() error {
+	var err error
+	if r.gz != nil {
+		err = r.gz.Close()
+	}
+	return errors.Join(err, r.f.Close())
+}
+
+// ReadFile returns every packet in the history file at path.
+func ReadFile(path string) (out []Packet, err error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return out, fmt.Errorf("%s: %w", path, err)
+		}
+		out = append(out, p)
+	}
+}
+
+// FileTopic returns the topic of the history file at path.
+func FileTopic(path string) (string, error) {
+	if IsUnmigrated(path) {
+		return DecodeTopic(filepath.Base(path))
+	}
+	return DecodeTopic(filepath.Base(filepath.Dir(path)))
+}
+
+// IsUnmigrated returns whether the file at path holds history from before it was kept in a directory per topic.
+// Such a file is JSONL named for its encoded topic, without a history extension, and is moved to legacyName by NewWriter.
+func IsUnmigrated(path string) bool {
+	_, _, ok := formatOf(filepath.Base(path))
+	return !ok
+}
+
+// Files returns every history file under dir, which is laid out as written by Writer, sorted by path.
+// This includes unmigrated files directly within dir.
+func Files(dir string) (out []string, err error) {
+	topics, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range topics {
+		if t.Type().IsRegular() && !strings.HasPrefix(t.Name(), ".") && IsUnmigrated(t.Name()) {
+			out = append(out, filepath.Join(dir, t.Name()))
+			continue
+		} else if !t.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, t.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if _, _, ok := formatOf(f.Name()); ok && f.Type().IsRegular() {
+				out = append(out, filepath.Join(dir, t.Name(), f.Name()))
+			}
+		}
+	}
+	return out, nil
+}
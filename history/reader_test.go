@@ -0,0 +1,53 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFilesUnmigrated(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "virt_powerwall"), []byte(`{"n":1,"p":{"a":1}}`+"\n"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, ".hidden"), nil, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "a_b"), 0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "a_b", "2024-01-01.jsonl"), []byte(`{"n":2,"p":{"b":true}}`+"\n"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := Files(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "a_b", "2024-01-01.jsonl"), filepath.Join(dir, "virt_powerwall")}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got %v, want %v", paths, want)
+	}
+
+	var got []Packet
+	for _, path := range paths {
+		ps, err := ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ps...)
+	}
+	wantPackets := []Packet{
+		{Topic: "a/b", When: 2, Packet: map[string]any{"b": true}},
+		{Topic: "virt/powerwall", When: 1, Packet: map[string]any{"a": 1.0}},
+	}
+	if !reflect.DeepEqual(got, wantPackets) {
+		t.Errorf("got %+v, want %+v", got, wantPackets)
+	}
+}
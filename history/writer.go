@@ -0,0 +1,554 @@
+package history
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyncEvery = time.Second * 10
+	maintainEvery    = time.Hour
+	closeIdleAfter   = time.Minute * 5 // files not written for this long are closed on sync
+	maxOpenFiles     = 256             // beyond this, the least recently written file is closed, e.g., for a wildcard over many topics
+
+	dayFormat  = "2006-01-02"
+	gzipExt    = ".gz"
+	legacyName = "legacy.jsonl"
+	migrateExt = ".migrating"
+)
+
+type WriterOptions struct {
+	Dir       string
+	Format    Format        // default FormatJSONL
+	Gzip      bool          // compress days once they are closed
+	SyncEvery time.Duration // default defaultSyncEvery
+	MaxAge    time.Duration // if non-zero, remove days older than this
+	MaxBytes  int64         // if non-zero, remove the oldest days while all days together are larger than this
+}
+
+// Writer writes packets to files partitioned by topic and UTC day, as "<dir>/<encoded topic>/YYYY-MM-DD.<format>".
+// Files are kept open while they're being written to, and synced regularly, up to maxOpenFiles.
+// A closed day is compressed and removed per the WriterOptions in the background.
+type Writer struct {
+	opts WriterOptions
+
+	lock        sync.Mutex
+	open        map[string]*dayFile // by encoded topic
+	compressing map[string]bool     // paths of days being compressed, which can't be reopened until done
+	compressed  *sync.Cond          // signalled with lock when a day is done compressing
+
+	maintainLock sync.Mutex // held throughout maintain, so it's never run concurrently
+
+	maintainCh chan struct{}
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+type dayFile struct {
+	f       *os.File
+	enc     encoder
+	topic   string // encoded
+	day     string
+	dirty   bool      // written since last sync
+	written time.Time // last write, to close idle files
+}
+
+// NewWriter returns a Writer for the given options.
+// Any history in the older format of a single file per topic is moved to "<dir>/<encoded topic>/legacy.jsonl".
+func NewWriter(opts WriterOptions) (*Writer, error) {
+	if opts.SyncEvery <= 0 {
+		opts.SyncEvery = defaultSyncEvery
+	}
+	if opts.Format == "" {
+		opts.Format = FormatJSONL
+	} else if !opts.Format.valid() {
+		return nil, fmt.Errorf("unknown history format %q", opts.Format)
+	}
+
+	err := os.MkdirAll(opts.Dir, 0775)
+	if err != nil {
+		return nil, err
+	}
+	err = migrateLegacy(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not migrate legacy history: %w", err)
+	}
+
+	w := &Writer{
+		opts:        opts,
+		open:        map[string]*dayFile{},
+		compressing: map[string]bool{},
+		maintainCh:  make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	w.compressed = sync.NewCond(&w.lock)
+	w.maintain()
+	go w.run()
+	return w, nil
+}
+
+// migrateLegacy moves any single-file history in dir into a per-topic directory.
+func migrateLegacy(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		// move aside first, as the directory has the same name as the file
+		name := strings.TrimSuffix(e.Name(), migrateExt)
+		from := filepath.Join(dir, e.Name())
+		aside := filepath.Join(dir, name+migrateExt)
+		if from != aside {
+			err = os.Rename(from, aside)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = os.MkdirAll(filepath.Join(dir, name), 0775)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(aside, filepath.Join(dir, name, legacyName))
+		if err != nil {
+			return err
+		}
+		logger().Info("migrated legacy history", "file", name)
+	}
+	return nil
+}
+
+func (w *Writer) run() {
+	defer close(w.stopped)
+
+	syncT := time.NewTicker(w.opts.SyncEvery)
+	defer syncT.Stop()
+	maintainT := time.NewTicker(maintainEvery)
+	defer maintainT.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-syncT.C:
+			w.sync()
+		case <-maintainT.C:
+			w.maintain()
+		case <-w.maintainCh:
+			w.maintain()
+		}
+	}
+}
+
+// Write appends the packet to the file for its topic and day.
+func (w *Writer) Write(p Packet) error {
+	_, _, err := w.WriteAll([]Packet{p})
+	return err
+}
+
+// WriteAll appends the packets in order to the files for their topics and days, writing each run of packets for the same file at once.
+// If a file can't be opened or written, its packets are returned as failed, in order so they can be retried, and other files are still written.
+// A packet which can't be encoded is logged and skipped, as retrying it won't help, so is neither written nor failed.
+func (w *Writer) WriteAll(ps []Packet) (written, failed []Packet, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var errs []error
+	bad := map[string]bool{} // files which failed, by encoded topic and day
+
+	var df *dayFile
+	var buf []byte
+	var run []Packet // packets in buf
+
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		_, err := df.f.Write(buf)
+		df.dirty = true
+		df.written = time.Now()
+		if err != nil {
+			w.discard(df)
+			bad[df.topic+"/"+df.day] = true
+			errs = append(errs, err)
+			failed = append(failed, run...)
+		} else {
+			written = append(written, run...)
+		}
+		buf, run = buf[:0], run[:0]
+	}
+
+	for _, p := range ps {
+		enc, err := EncodeTopic(p.Topic)
+		if err != nil {
+			logger().Warn("could not encode history topic, skipping", "topic", p.Topic, "err", err)
+			continue
+		}
+		day := time.Unix(p.When, 0).UTC().Format(dayFormat)
+
+		// keep the file's packets in order, even if it would work again
+		if bad[enc+"/"+day] {
+			failed = append(failed, p)
+			continue
+		}
+
+		if df == nil || df.topic != enc || df.day != day {
+			flush()
+			df, err = w.fileFor(enc, day)
+			if err != nil {
+				bad[enc+"/"+day] = true
+				errs = append(errs, err)
+				failed = append(failed, p)
+				continue
+			}
+		}
+
+		b, err := df.enc.encode(p)
+		if err != nil {
+			logger().Warn("could not encode history, skipping", "topic", p.Topic, "err", err)
+			continue
+		}
+		buf = append(buf, b...)
+		run = append(run, p)
+	}
+
+	flush()
+	return written, failed, errors.Join(errs...)
+}
+
+// fileFor returns the open file for the encoded topic and day, opening it if needed.
+// Must be called with lock held.
+func (w *Writer) fileFor(enc, day string) (*dayFile, error) {
+	df := w.open[enc]
+	if df != nil && df.day == day {
+		return df, nil
+	}
+
+	if df != nil {
+		delete(w.open, enc)
+		err := df.close()
+		if err != nil {
+			return nil, err
+		}
+
+		// compress the closed day
+		select {
+		case w.maintainCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return w.openFile(enc, day)
+}
+
+// discard closes a file after a failed write, so it's reopened on the next write.
+// Reopening removes any partially written packet, and restores the encoder's state from what's on disk.
+// Must be called with lock held.
+func (w *Writer) discard(df *dayFile) {
+	delete(w.open, df.topic)
+	df.f.Close()
+}
+
+// openFile opens the file for the encoded topic and day, waiting if it's being compressed.
+// Must be called with lock held.
+func (w *Writer) openFile(enc, day string) (*dayFile, error) {
+	dir := filepath.Join(w.opts.Dir, enc)
+	path := filepath.Join(dir, day+w.opts.Format.ext())
+	for w.compressing[path] {
+		w.compressed.Wait()
+	}
+
+	// another write may have opened it while waiting
+	if df := w.open[enc]; df != nil && df.day == day {
+		return df, nil
+	}
+
+	if len(w.open) >= maxOpenFiles {
+		oldest := slices.MinFunc(slices.Collect(maps.Values(w.open)), func(a, b *dayFile) int {
+			return a.written.Compare(b.written)
+		})
+		w.closeFile(oldest)
+	}
+
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return nil, err
+	}
+	f, fe, err := openAppend(path, w.opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	df := &dayFile{f: f, enc: fe, topic: enc, day: day, written: time.Now()}
+	w.open[enc] = df
+	return df, nil
+}
+
+// closeFile closes a file which is still wanted, but not right now; it's reopened on the next write.
+// Must be called with lock held.
+func (w *Writer) closeFile(df *dayFile) {
+	delete(w.open, df.topic)
+	err := df.close()
+	if err != nil {
+		logger().Warn("could not close history", "path", df.f.Name(), "err", err)
+	}
+}
+
+func (df *dayFile) close() error {
+	err := df.f.Sync()
+	return errors.Join(err, df.f.Close())
+}
+
+// sync syncs every file written to since the last sync, and closes idle files.
+func (w *Writer) sync() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, df := range w.open {
+		if time.Since(df.written) > closeIdleAfter {
+			w.closeFile(df)
+			continue
+		} else if !df.dirty {
+			continue
+		}
+		err := df.f.Sync()
+		if err != nil {
+			logger().Warn("could not sync history", "path", df.f.Name(), "err", err)
+			continue
+		}
+		df.dirty = false
+	}
+}
+
+// Close syncs and closes all files.
+func (w *Writer) Close() error {
+	close(w.done)
+	<-w.stopped
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var errs []error
+	for enc, df := range w.open {
+		errs = append(errs, df.close())
+		delete(w.open, enc)
+	}
+	return errors.Join(errs...)
+}
+
+// dayEntry is a day of history on disk.
+type dayEntry struct {
+	enc  string
+	day  string
+	path string
+	size int64
+}
+
+// maintain compresses closed days and applies retention.
+// Compression happens without the lock, so writes to other days aren't blocked; only the day being compressed can't be reopened.
+func (w *Writer) maintain() {
+	w.maintainLock.Lock()
+	defer w.maintainLock.Unlock()
+
+	entries, err := w.listDays()
+	if err != nil {
+		logger().Warn("could not list history", "err", err)
+		return
+	}
+
+	today := time.Now().UTC().Format(dayFormat)
+	var cutoff string
+	if w.opts.MaxAge > 0 {
+		cutoff = time.Now().Add(-w.opts.MaxAge).UTC().Format(dayFormat)
+	}
+
+	if w.opts.Gzip {
+		for i, e := range entries {
+			if e.day >= today || e.day < cutoff || strings.HasSuffix(e.path, gzipExt) {
+				continue
+			}
+			size, ok := w.compressDay(e)
+			if ok {
+				entries[i].path += gzipExt
+				entries[i].size = size
+			}
+		}
+	}
+
+	remove := func(e dayEntry, reason string) {
+		err := os.Remove(e.path)
+		if err != nil {
+			logger().Warn("could not remove history", "path", e.path, "err", err)
+			return
+		}
+		logger().Info("removed history", "path", e.path, "reason", reason)
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+
+	// hold the lock so that a late packet can't reopen a day being removed
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// entries are sorted oldest first
+	for _, e := range entries {
+		if w.isOpen(e) {
+			continue
+		}
+		if e.day < cutoff {
+			remove(e, "maxAge")
+			total -= e.size
+		} else if w.opts.MaxBytes > 0 && total > w.opts.MaxBytes {
+			remove(e, "maxBytes")
+			total -= e.size
+		}
+	}
+}
+
+// compressDay compresses a closed day, unless it's been reopened, returning its compressed size.
+// While compressing, writes to that day wait in openFile.
+func (w *Writer) compressDay(e dayEntry) (size int64, ok bool) {
+	w.lock.Lock()
+	if w.isOpen(e) {
+		w.lock.Unlock()
+		return 0, false
+	}
+	w.compressing[e.path] = true
+	w.lock.Unlock()
+
+	defer func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		delete(w.compressing, e.path)
+		w.compressed.Broadcast()
+	}()
+
+	size, err := compressFile(e.path)
+	if err != nil {
+		logger().Warn("could not compress history", "path", e.path, "err", err)
+		return 0, false
+	}
+	return size, true
+}
+
+// isOpen returns whether the day is open for writing.
+// Must be called with lock held.
+func (w *Writer) isOpen(e dayEntry) bool {
+	df := w.open[e.enc]
+	return df != nil && df.f.Name() == e.path
+}
+
+// listDays returns all days on disk, oldest first.
+func (w *Writer) listDays() (out []dayEntry, err error) {
+	topics, err := os.ReadDir(w.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range topics {
+		if !t.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(w.opts.Dir, t.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			format, _, ok := formatOf(f.Name())
+			if !ok || !f.Type().IsRegular() {
+				continue
+			}
+			day := strings.TrimSuffix(strings.TrimSuffix(f.Name(), gzipExt), format.ext())
+			if _, err := time.Parse(dayFormat, day); err != nil {
+				continue // e.g., legacy.jsonl
+			}
+
+			info, err := f.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			out = append(out, dayEntry{
+				enc:  t.Name(),
+				day:  day,
+				path: filepath.Join(w.opts.Dir, t.Name(), f.Name()),
+				size: info.Size(),
+			})
+		}
+	}
+
+	slices.SortFunc(out, func(a, b dayEntry) int {
+		return strings.Compare(a.day+"/"+a.enc, b.day+"/"+b.enc)
+	})
+	return out, nil
+}
+
+// compressFile gzips the file at path to path+".gz" and removes the original, returning the compressed size.
+// If the ".gz" already exists (a late packet reopened the day), this appends a new gzip member to it.
+func compressFile(path string) (size int64, err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	target := path + gzipExt
+	tmp := target + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp) // no-op on success
+
+	if existing, err := os.Open(target); err == nil {
+		_, err = io.Copy(out, existing)
+		existing.Close()
+		if err != nil {
+			out.Close()
+			return 0, err
+		}
+	}
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		size, err = out.Seek(0, io.SeekCurrent)
+	}
+	err = errors.Join(err, out.Close())
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Rename(tmp, target)
+	if err != nil {
+		return 0, err
+	}
+	return size, os.Remove(path)
+}
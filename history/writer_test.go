@@ -0,0 +1,243 @@
+package history
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestWriter(t *testing.T, opts WriterOptions) *Writer {
+	opts.Dir = t.TempDir()
+	w, err := NewWriter(opts)
+	if err != nil {
+		t.Fatalf("could not create writer: %v", err)
+	}
+	return w
+}
+
+func dayPath(w *Writer, topic string, day time.Time) string {
+	enc, _ := EncodeTopic(topic)
+	return filepath.Join(w.opts.Dir, enc, day.UTC().Format(dayFormat)+w.opts.Format.ext())
+}
+
+func readGzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("could not read gzip: %v", err)
+	}
+	b, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("could not read gzip: %v", err)
+	}
+	return string(b)
+}
+
+func TestWriterPartition(t *testing.T) {
+	w := newTestWriter(t, WriterOptions{})
+	yesterday := time.Now().Add(-time.Hour * 24)
+	now := time.Now()
+
+	for _, p := range []Packet{
+		{Topic: "a/b", When: yesterday.Unix(), Packet: map[string]any{"x": 1.0}},
+		{Topic: "a/b", When: now.Unix(), Packet: map[string]any{"x": 2.0}},
+		{Topic: "c", When: now.Unix(), Packet: map[string]any{"x": 3.0}},
+	} {
+		if err := w.Write(p); err != nil {
+			t.Fatalf("could not write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("could not close: %v", err)
+	}
+
+	for path, want := range map[string]string{
+		dayPath(w, "a/b", yesterday): fmt.Sprintf(`{"n":%d,"p":{"x":1}}`+"\n", yesterday.Unix()),
+		dayPath(w, "a/b", now):       fmt.Sprintf(`{"n":%d,"p":{"x":2}}`+"\n", now.Unix()),
+		dayPath(w, "c", now):         fmt.Sprintf(`{"n":%d,"p":{"x":3}}`+"\n", now.Unix()),
+	} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("could not read %s: %v", path, err)
+		} else if string(b) != want {
+			t.Errorf("%s = %q, want %q", path, b, want)
+		}
+	}
+}
+
+func TestWriterCompress(t *testing.T) {
+	w := newTestWriter(t, WriterOptions{Gzip: true})
+	defer w.Close()
+	old := time.Now().Add(-time.Hour * 48)
+
+	w.Write(Packet{Topic: "a", When: old.Unix(), Packet: map[string]any{"x": 1.0}})
+	w.Write(Packet{Topic: "a", When: time.Now().Unix(), Packet: map[string]any{"x": 2.0}}) // closes the old day
+	w.maintain()
+
+	path := dayPath(w, "a", old)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got err=%v", path, err)
+	}
+	want := fmt.Sprintf(`{"n":%d,"p":{"x":1}}`+"\n", old.Unix())
+	if got := readGzip(t, path+gzipExt); got != want {
+		t.Errorf("compressed = %q, want %q", got, want)
+	}
+
+	// a late packet reopens the day, and is appended to the compressed day
+	w.Write(Packet{Topic: "a", When: old.Unix(), Packet: map[string]any{"x": 3.0}})
+	w.Write(Packet{Topic: "a", When: time.Now().Unix(), Packet: map[string]any{"x": 4.0}})
+	w.maintain()
+
+	want += fmt.Sprintf(`{"n":%d,"p":{"x":3}}`+"\n", old.Unix())
+	if got := readGzip(t, path+gzipExt); got != want {
+		t.Errorf("compressed = %q, want %q", got, want)
+	}
+}
+
+func TestWriterWaitsForCompress(t *testing.T) {
+	w := newTestWriter(t, WriterOptions{Gzip: true})
+	defer w.Close()
+	old := time.Now().Add(-time.Hour * 48)
+
+	// pretend maintain is compressing this day
+	path := dayPath(w, "a", old)
+	w.lock.Lock()
+	w.compressing[path] = true
+	w.lock.Unlock()
+
+	done := make(chan error)
+	go func() {
+		done <- w.Write(Packet{Topic: "a", When: old.Unix()})
+	}()
+
+	// other days and topics aren't blocked
+	if err := w.Write(Packet{Topic: "a", When: time.Now().Unix()}); err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	if err := w.Write(Packet{Topic: "b", When: old.Unix()}); err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+
+	select {
+	case <-done:
+		t.Fatalf("write to day being compressed didn't wait")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	w.lock.Lock()
+	delete(w.compressing, path)
+	w.compressed.Broadcast()
+	w.lock.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected %s to exist: %v", path, err)
+	}
+}
+
+func TestWriterRetention(t *testing.T) {
+	w := newTestWriter(t, WriterOptions{MaxAge: time.Hour * 24 * 3})
+	defer w.Close()
+	old := time.Now().Add(-time.Hour * 24 * 5)
+	recent := time.Now().Add(-time.Hour * 24)
+
+	w.Write(Packet{Topic: "a", When: old.Unix()})
+	w.Write(Packet{Topic: "b", When: recent.Unix()})
+	w.Write(Packet{Topic: "a", When: time.Now().Unix()})
+	w.maintain()
+
+	if _, err := os.Stat(dayPath(w, "a", old)); !os.IsNotExist(err) {
+		t.Errorf("expected old day to be removed, got err=%v", err)
+	}
+	if _, err := os.Stat(dayPath(w, "b", recent)); err != nil {
+		t.Errorf("expected recent day to be kept: %v", err)
+	}
+}
+
+func TestWriterOpenFiles(t *testing.T) {
+	w := newTestWriter(t, WriterOptions{})
+	defer w.Close()
+
+	for i := range maxOpenFiles + 10 {
+		if err := w.Write(Packet{Topic: fmt.Sprintf("t/%d", i), When: time.Now().Unix()}); err != nil {
+			t.Fatalf("could not write: %v", err)
+		}
+	}
+
+	firstEnc, _ := EncodeTopic("t/0")
+	w.lock.Lock()
+	open := len(w.open)
+	_, first := w.open[firstEnc]
+	w.lock.Unlock()
+	if open != maxOpenFiles {
+		t.Errorf("open=%d, want %d", open, maxOpenFiles)
+	}
+	if first {
+		t.Errorf("least recently written file should be closed")
+	}
+
+	// idle files are closed on sync
+	w.lock.Lock()
+	for _, df := range w.open {
+		df.written = time.Now().Add(-closeIdleAfter * 2)
+	}
+	w.lock.Unlock()
+	w.sync()
+
+	w.lock.Lock()
+	open = len(w.open)
+	w.lock.Unlock()
+	if open != 0 {
+		t.Errorf("open=%d after idle, want 0", open)
+	}
+
+	// and reopened on the next write
+	if err := w.Write(Packet{Topic: "t/0", When: time.Now().Unix()}); err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+}
+
+func TestWriteAllFailedFile(t *testing.T) {
+	w := newTestWriter(t, WriterOptions{})
+	defer w.Close()
+
+	// a file where the topic's directory should be, so it can't be opened
+	bad, _ := EncodeTopic("bad/topic")
+	if err := os.WriteFile(filepath.Join(w.opts.Dir, bad), nil, 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	when := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	ps := []Packet{
+		{Topic: "good/topic", When: when.Unix(), Packet: map[string]any{"a": 1.0}},
+		{Topic: "bad/topic", When: when.Unix(), Packet: map[string]any{"a": 2.0}},
+		{Topic: "good/topic", When: when.Unix() + 1, Packet: map[string]any{"a": 3.0}},
+		{Topic: "bad/topic", When: when.Unix() + 1, Packet: map[string]any{"a": 4.0}},
+		{Topic: "", When: when.Unix(), Packet: map[string]any{"a": 5.0}}, // can't be encoded
+	}
+	written, failed, err := w.WriteAll(ps)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+	if len(written) != 2 || written[0].Packet["a"] != 1.0 || written[1].Packet["a"] != 3.0 {
+		t.Errorf("got written %+v", written)
+	}
+	if len(failed) != 2 || failed[0].Packet["a"] != 2.0 || failed[1].Packet["a"] != 4.0 {
+		t.Errorf("got failed %+v", failed)
+	}
+
+	got, err := ReadFile(dayPath(w, "good/topic", when))
+	if err != nil || len(got) != 2 {
+		t.Errorf("got %+v, %v", got, err)
+	}
+}
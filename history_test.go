@@ -0,0 +1,263 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHistorySkip(t *testing.T) {
+	req := &HistoryReq{MinDuration: time.Minute}
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		wantSkip string
+		wantIdle bool
+	}{
+		{"new", time.Time{}, "", true},
+		{"just written", now.Add(-time.Second), "throttled", false},
+		{"under half", now.Add(-time.Second * 29), "throttled", false},
+		{"half", now.Add(-time.Second * 30), "", true},
+		{"long ago", now.Add(-time.Hour), "", true},
+	}
+
+	for _, tt := range tests {
+		s := &historySeries{at: tt.at}
+		if got := req.skip(s, map[string]any{"a": 1.0}, now); got != tt.wantSkip {
+			t.Errorf("%s: skip=%q, want %q", tt.name, got, tt.wantSkip)
+		}
+		if got := req.idle(s, now); got != tt.wantIdle {
+			t.Errorf("%s: idle=%v, want %v", tt.name, got, tt.wantIdle)
+		}
+	}
+}
+
+func TestDeadbandExceeded(t *testing.T) {
+	tests := []struct {
+		name       string
+		d          Deadband
+		last, next any
+		want       bool
+	}{
+		{"zero same", Deadband{}, 1.0, 1.0, false},
+		{"zero changed", Deadband{}, 1.0, 1.01, true},
+		{"abs within", Deadband{Abs: 50}, 100.0, 150.0, false},
+		{"abs beyond", Deadband{Abs: 50}, 100.0, 151.0, true},
+		{"abs down", Deadband{Abs: 50}, 100.0, 49.0, true},
+		{"pct within", Deadband{Pct: 10}, 1000.0, 1090.0, false},
+		{"pct beyond", Deadband{Pct: 10}, 1000.0, 1101.0, true},
+		{"larger of abs and pct", Deadband{Abs: 50, Pct: 10}, 100.0, 140.0, false},
+		{"larger of pct and abs", Deadband{Abs: 50, Pct: 10}, 1000.0, 1060.0, false},
+		{"pct of zero", Deadband{Pct: 10}, 0.0, 0.1, true},
+		{"bool same", Deadband{Abs: 50}, true, true, false},
+		{"bool changed", Deadband{Abs: 50}, true, false, true},
+		{"string changed", Deadband{}, "cool", "heat", true},
+		{"type changed", Deadband{Abs: 50}, 1.0, true, true},
+		{"new key", Deadband{Abs: 50}, nil, 1.0, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.d.exceeded(tt.last, tt.next); got != tt.want {
+			t.Errorf("%s: exceeded(%v, %v) = %v, want %v", tt.name, tt.last, tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestDeadbandFor(t *testing.T) {
+	req := &HistoryReq{Deadband: map[string]Deadband{
+		"*":             {Abs: 1},
+		"power*":        {Abs: 2},
+		"power.*":       {Abs: 3},
+		"power.battery": {Abs: 4},
+		"temp.?":        {Abs: 5},
+		"temp.a":        {Abs: 6},
+		"tem?.b":        {Abs: 7},
+	}}
+
+	tests := []struct {
+		key  string
+		want float64
+	}{
+		{"power.battery", 4}, // exact
+		{"power.solar", 3},   // longest pattern
+		{"powerwall", 2},
+		{"humidity", 1},
+		{"temp.a", 6},
+		{"temp.b", 7}, // "temp.?" and "tem?.b" are the same length, so the first in order is used
+		{"temp.c", 5},
+	}
+
+	for _, tt := range tests {
+		d, ok := req.deadbandFor(tt.key)
+		if !ok || d.Abs != tt.want {
+			t.Errorf("deadbandFor(%q) = %v, %v, want abs=%v", tt.key, d, ok, tt.want)
+		}
+	}
+
+	req = &HistoryReq{Deadband: map[string]Deadband{"power": {Abs: 1}}}
+	if _, ok := req.deadbandFor("temperature"); ok {
+		t.Errorf("expected no deadband for unmatched key")
+	}
+}
+
+func TestHistorySkipDeadband(t *testing.T) {
+	req := &HistoryReq{
+		MinDuration: time.Minute,
+		Deadband:    map[string]Deadband{"power": {Abs: 50}, "on": {}},
+	}
+	now := time.Now()
+	last := map[string]any{"power": 100.0, "on": true, "temperature": 20.0}
+
+	tests := []struct {
+		name     string
+		req      *HistoryReq
+		since    time.Duration
+		packet   map[string]any
+		wantSkip string
+		wantIdle bool
+	}{
+		{"unchanged", req, time.Minute, map[string]any{"power": 120.0, "on": true}, "unchanged", false},
+		{"exceeded", req, time.Minute, map[string]any{"power": 200.0, "on": true}, "", false},
+		{"bool changed", req, time.Minute, map[string]any{"power": 100.0, "on": false}, "", false},
+		{"untracked changed", req, time.Minute, map[string]any{"temperature": 30.0}, "unchanged", false},
+		{"exceeded too soon", req, time.Second * 10, map[string]any{"power": 200.0}, "throttled", false},
+		{"partial unchanged", req, time.Minute, map[string]any{"on": true}, "unchanged", false},
+		{"partial exceeded", req, time.Minute, map[string]any{"power": 0.0}, "", false},
+		{"heartbeat", req, time.Minute * 10, map[string]any{"power": 100.0}, "", true},
+		{
+			name:     "custom spacing",
+			req:      &HistoryReq{MinDuration: time.Minute, MinSpacing: time.Second, Deadband: req.Deadband},
+			since:    time.Second * 10,
+			packet:   map[string]any{"power": 200.0},
+			wantSkip: "",
+		},
+		{
+			name:     "custom heartbeat",
+			req:      &HistoryReq{MinDuration: time.Minute, MaxInterval: time.Minute * 2, Deadband: req.Deadband},
+			since:    time.Minute * 2,
+			packet:   map[string]any{"power": 100.0},
+			wantSkip: "",
+			wantIdle: true,
+		},
+	}
+
+	for _, tt := range tests {
+		s := &historySeries{at: now.Add(-tt.since), last: last}
+		if got := tt.req.skip(s, tt.packet, now); got != tt.wantSkip {
+			t.Errorf("%s: skip=%q, want %q", tt.name, got, tt.wantSkip)
+		}
+		if got := tt.req.idle(s, now); got != tt.wantIdle {
+			t.Errorf("%s: idle=%v, want %v", tt.name, got, tt.wantIdle)
+		}
+	}
+}
+
+func TestHistorySeriesRecord(t *testing.T) {
+	req := &HistoryReq{MinDuration: time.Minute, Deadband: map[string]Deadband{"*": {Abs: 10}}}
+	now := time.Now()
+	s := &historySeries{}
+
+	steps := []struct {
+		packet   map[string]any
+		wantSkip string
+	}{
+		{map[string]any{"a": 1.0, "b": 1.0}, ""}, // new series
+		{map[string]any{"b": 50.0}, ""},          // partial, and merged into last
+		{map[string]any{"a": 1.0}, "unchanged"},  // a is still known
+		{map[string]any{"b": 55.0}, "unchanged"}, // compared to the merged b
+		{map[string]any{"a": 20.0, "b": 55.0}, ""},
+	}
+
+	for i, step := range steps {
+		now = now.Add(time.Minute)
+		got := req.skip(s, step.packet, now)
+		if got != step.wantSkip {
+			t.Fatalf("step %d: skip=%q, want %q", i, got, step.wantSkip)
+		}
+		if got == "" {
+			s.record(step.packet, now)
+		}
+	}
+
+	want := map[string]any{"a": 20.0, "b": 55.0}
+	if !maps.Equal(s.last, want) {
+		t.Errorf("last=%v, want %v", s.last, want)
+	}
+}
+
+func TestHistoryRecordable(t *testing.T) {
+	req := &HistoryReq{
+		StringKeys: []string{"update.state", "mode"},
+		Include:    []string{"update.*", "mode", "temp*", "on"},
+		Exclude:    []string{"temp_internal"},
+	}
+
+	tests := []struct {
+		key   string
+		value any
+		want  bool
+	}{
+		{"temperature", 21.5, true},
+		{"on", true, true},
+		{"mode", "cool", true},
+		{"update.state", "idle", true},
+		{"update.progress", 50.0, true},
+		{"update.version", "1.2", false}, // not a string key
+		{"temp_internal", 30.0, false},   // excluded
+		{"power", 100.0, false},          // not included
+		{"on", nil, false},
+		{"on", map[string]any{}, false},
+	}
+
+	for _, tt := range tests {
+		if got := req.recordable(tt.key, tt.value); got != tt.want {
+			t.Errorf("recordable(%q, %v) = %v, want %v", tt.key, tt.value, got, tt.want)
+		}
+	}
+
+	// without Include, every number and bool is recorded
+	req = &HistoryReq{}
+	if !req.recordable("anything", 1.0) || req.recordable("anything", "str") {
+		t.Errorf("default recordable is wrong")
+	}
+}
+
+func TestGetTopics(t *testing.T) {
+	for _, topic := range []string{"virt/daikin-ac/den", "virt/daikin-ac/loft", "virt/powerwall"} {
+		rd := &registeredDevice{topic: topic, state: &deviceState{}}
+		t.Cleanup(deviceRegistry.add(topic, rd))
+	}
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"zigbee2mqtt/device/power/rack", []string{"zigbee2mqtt/device/power/rack"}},
+		{"virt/daikin-ac/+", []string{"virt/daikin-ac/den", "virt/daikin-ac/loft"}},
+		{"virt/#", []string{"virt/daikin-ac/den", "virt/daikin-ac/loft", "virt/powerwall"}},
+		{"zigbee2mqtt/#", nil}, // never "zigbee2mqtt/bridge/...", or other topics merely seen
+	}
+
+	for _, tt := range tests {
+		if got := getTopics(tt.topic); !slices.Equal(got, tt.want) {
+			t.Errorf("getTopics(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestIsRequestTopic(t *testing.T) {
+	for topic, want := range map[string]bool{
+		"virt/daikin-ac/den":            false,
+		"virt/daikin-ac/den/get":        true,
+		"virt/daikin-ac/den/set":        true,
+		"virt/daikin-ac/den/set/result": true,
+		"virt/settings":                 false,
+	} {
+		if got := isRequestTopic(topic); got != want {
+			t.Errorf("isRequestTopic(%q) = %v, want %v", topic, got, want)
+		}
+	}
+}
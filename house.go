@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	configPollEvery = time.Second * 5
+)
+
+// house tracks the devices and history started from a Config, so that a reload only stops and starts what changed.
+type house struct {
+	ctx context.Context
+	pw  *pahoWrap
+	q   *historyQueue // nil if not recording history
+
+	lock    sync.Mutex
+	stopped bool
+	initial *Config // the config at startup, parts of which can't be changed
+	devices map[string]running
+	history map[string]running
+}
+
+// startSpec describes something to start, keyed by topic.
+type startSpec struct {
+	key       any // must be comparable; if this changes on reload, restart
+	start     func() (stop func())
+	forget    func() // optional, called after stop when removed from the config (but not on shutdown)
+	forgetKey any    // must be comparable; if this changes on reload, the old forget is also called
+}
+
+type running struct {
+	key       any
+	stop      func()
+	forget    func()
+	forgetKey any
+}
+
+func newHouse(ctx context.Context, pw *pahoWrap, q *historyQueue) *house {
+	return &house{
+		ctx:     ctx,
+		pw:      pw,
+		q:       q,
+		devices: map[string]running{},
+		history: map[string]running{},
+	}
+}
+
+// apply starts and stops devices and history to match the given config.
+func (h *house) apply(cfg *Config) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.stopped {
+		return
+	}
+
+	if h.initial == nil {
+		h.initial = cfg
+	} else {
+		if h.initial.MQTT != cfg.MQTT {
+			logConfig.Warn("mqtt config changed, ignoring until restart")
+		}
+		if h.initial.HTTP != cfg.HTTP {
+			logConfig.Warn("http config changed, ignoring until restart")
+		}
+		if h.initial.HistoryFiles != cfg.HistoryFiles {
+			logConfig.Warn("historyFiles config changed, ignoring until restart")
+		}
+		if h.initial.LineSink != cfg.LineSink {
+			logConfig.Warn("lineSink config changed, ignoring until restart")
+		}
+	}
+
+	setupLogging(cfg.Log) // only levels can change after startup
+
+	reconcile("device", h.devices, configDevices(h.ctx, h.pw, cfg), true)
+
+	records := map[string]startSpec{}
+	if h.q != nil {
+		for _, hc := range cfg.History {
+			req := &HistoryReq{
+				Paho:        h.pw,
+				Topic:       hc.Topic,
+				MinDuration: time.Duration(hc.MinDuration),
+				Queue:       h.q,
+				GetKey:      hc.GetKey,
+				StaleAfter:  time.Duration(hc.StaleAfter),
+				StringKeys:  hc.StringKeys,
+				Include:     hc.Include,
+				Exclude:     hc.Exclude,
+				Deadband:    hc.Deadband,
+				MaxInterval: time.Duration(hc.MaxInterval),
+				MinSpacing:  time.Duration(hc.MinSpacing),
+			}
+			records[hc.Topic] = startSpec{key: hc.key(), start: func() func() { return History(h.ctx, req) }}
+		}
+	}
+	reconcile("history", h.history, records, true)
+}
+
+// stop stops all devices and history, waiting for any in-flight work.
+// Future calls to apply do nothing.
+func (h *house) stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.stopped = true
+	reconcile("device", h.devices, nil, false)
+	reconcile("history", h.history, nil, false)
+}
+
+// reconcile stops anything in current which is missing or changed in desired, then starts anything new.
+// If forget is true, anything missing from desired is also forgotten, as is anything whose forgetKey changed.
+func reconcile(kind string, current map[string]running, desired map[string]startSpec, forget bool) {
+	for topic, r := range current {
+		spec, ok := desired[topic]
+		if ok && spec.key == r.key {
+			continue
+		}
+		logConfig.Info("stopping", "kind", kind, "topic", topic)
+		r.stop()
+		delete(current, topic)
+
+		if r.forget != nil && ((!ok && forget) || (ok && spec.forgetKey != r.forgetKey)) {
+			r.forget()
+		}
+	}
+
+	for topic, spec := range desired {
+		if _, ok := current[topic]; ok {
+			continue
+		}
+		logConfig.Info("starting", "kind", kind, "topic", topic)
+		current[topic] = running{key: spec.key, stop: spec.start(), forget: spec.forget, forgetKey: spec.forgetKey}
+	}
+}
+
+// watchConfig reloads the config at path when it changes on disk, or when SIGHUP is received.
+// Invalid configs are logged and ignored.
+// This returns when ctx is done.
+func watchConfig(ctx context.Context, path string, h *house) {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	t := time.NewTicker(configPollEvery)
+	defer t.Stop()
+
+	lastMod := modTime(path)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupCh:
+			logConfig.Info("got SIGHUP, reloading", "path", path)
+		case <-t.C:
+			mod := modTime(path)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			logConfig.Info("config changed, reloading", "path", path)
+		}
+
+		cfg, err := loadConfig(path)
+		if err != nil {
+			logConfig.Error("not reloading, bad config", "err", err)
+			continue
+		}
+		h.apply(cfg)
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	var events []string
+	spec := func(topic string, key, forgetKey any) startSpec {
+		return startSpec{
+			key: key,
+			start: func() func() {
+				events = append(events, "start "+topic)
+				return func() { events = append(events, "stop "+topic) }
+			},
+			forget:    func() { events = append(events, "forget "+topic) },
+			forgetKey: forgetKey,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		desired map[string]startSpec
+		forget  bool
+		want    []string // sorted
+	}{
+		{"initial", map[string]startSpec{"a": spec("a", 1, "x"), "b": spec("b", 1, "x")}, true, []string{"start a", "start b"}},
+		{"unchanged", map[string]startSpec{"a": spec("a", 1, "x"), "b": spec("b", 1, "x")}, true, nil},
+		{"changed", map[string]startSpec{"a": spec("a", 2, "x"), "b": spec("b", 1, "x")}, true, []string{"start a", "stop a"}},
+		{"forgetKey changed", map[string]startSpec{"a": spec("a", 3, "y"), "b": spec("b", 1, "x")}, true, []string{"forget a", "start a", "stop a"}},
+		{"added and removed", map[string]startSpec{"a": spec("a", 3, "y"), "c": spec("c", 1, "x")}, true, []string{"forget b", "start c", "stop b"}},
+		{"stopped without forgetting", nil, false, []string{"stop a", "stop c"}},
+	}
+
+	current := map[string]running{}
+	for _, tt := range tests {
+		events = nil
+		reconcile("test", current, tt.desired, tt.forget)
+		slices.Sort(events)
+		if !slices.Equal(events, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, events, tt.want)
+		}
+		if len(current) != len(tt.desired) {
+			t.Errorf("%s: got %d running, want %d", tt.name, len(current), len(tt.desired))
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/samthor/gohaus/api/daikin"
+	"github.com/samthor/gohaus/api/powerwall"
+	"github.com/samthor/gohaus/history"
+)
+
+// subsystems are the names that log levels can be set for.
+var subsystems = []string{"main", "config", "mqtt", "device", "discovery", "history", "http", "daikin", "powerwall"}
+
+var (
+	logMain      = newLogger("main")
+	logConfig    = newLogger("config")
+	logMQTT      = newLogger("mqtt")
+	logDevice    = newLogger("device")
+	logDiscovery = newLogger("discovery")
+	logHistory   = newLogger("history")
+	logHTTP      = newLogger("http")
+)
+
+var (
+	logRootLock sync.RWMutex
+	logRoot     slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+	logLevels = map[string]*slog.LevelVar{}
+
+	logTopicLock   sync.RWMutex
+	logTopicLevels = map[string]slog.Level{} // overrides the subsystem's level for a device or history topic
+)
+
+func init() {
+	for _, name := range subsystems {
+		logLevels[name] = &slog.LevelVar{}
+	}
+	daikin.Logger = newLogger("daikin")
+	powerwall.Logger = newLogger("powerwall")
+	history.Logger = logHistory
+	slog.SetDefault(logMain)
+}
+
+// newLogger returns a logger for the named subsystem, whose level is set by setupLogging.
+func newLogger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem}).With("sys", subsystem)
+}
+
+// topicLogger returns a logger for a device or history topic, whose level may be overridden via LogConfig.Topics.
+func topicLogger(l *slog.Logger, topic string) *slog.Logger {
+	if h, ok := l.Handler().(*subsystemHandler); ok {
+		l = slog.New(&subsystemHandler{subsystem: h.subsystem, topic: topic, wrap: h.wrap})
+	}
+	return l.With("topic", topic)
+}
+
+type logTopicKey struct{}
+
+// withLogTopic returns a context whose topic's level applies to logs written with it, e.g., by the api packages.
+func withLogTopic(ctx context.Context, topic string) context.Context {
+	return context.WithValue(ctx, logTopicKey{}, topic)
+}
+
+// subsystemHandler filters by its topic's or subsystem's level, and passes records to the current logRoot.
+// This lets loggers be created before flags and config are read.
+type subsystemHandler struct {
+	subsystem string
+	topic     string                            // if empty, read from the context passed to Enabled
+	wrap      []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls, applied in order
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	topic := h.topic
+	if topic == "" && ctx != nil {
+		topic, _ = ctx.Value(logTopicKey{}).(string)
+	}
+	if topic != "" {
+		logTopicLock.RLock()
+		lv, ok := logTopicLevels[topic]
+		logTopicLock.RUnlock()
+		if ok {
+			return level >= lv
+		}
+	}
+
+	lv, ok := logLevels[h.subsystem]
+	if !ok {
+		return level >= slog.LevelInfo
+	}
+	return level >= lv.Level()
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	logRootLock.RLock()
+	out := logRoot
+	logRootLock.RUnlock()
+
+	for _, wrap := range h.wrap {
+		out = wrap(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) with(wrap func(slog.Handler) slog.Handler) *subsystemHandler {
+	return &subsystemHandler{subsystem: h.subsystem, topic: h.topic, wrap: append(h.wrap[:len(h.wrap):len(h.wrap)], wrap)}
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+// fatal logs at error level and exits, like log.Fatalf.
+func fatal(msg string, args ...any) {
+	logMain.Error(msg, args...)
+	os.Exit(1)
+}
+
+// LogConfig configures logging.
+type LogConfig struct {
+	JSON   bool              `json:"json"`   // only read at startup
+	Level  string            `json:"level"`  // default level, e.g. "debug", "info" (default), "warn", "error"
+	Levels map[string]string `json:"levels"` // per-subsystem level, e.g. {"daikin": "debug"}
+	Topics map[string]string `json:"topics"` // per-topic level for devices and history, overriding the subsystem's, e.g. {"virt/daikin-ac/lounge": "debug"}
+}
+
+// parseLevels parses the levels, returning the level for each subsystem.
+func (lc *LogConfig) parseLevels() (out map[string]slog.Level, err error) {
+	var base slog.Level
+	if lc.Level != "" {
+		err = base.UnmarshalText([]byte(lc.Level))
+		if err != nil {
+			return nil, fmt.Errorf("level: %w", err)
+		}
+	}
+
+	out = map[string]slog.Level{}
+	for _, name := range subsystems {
+		out[name] = base
+	}
+	for name, s := range lc.Levels {
+		if _, ok := out[name]; !ok {
+			return nil, fmt.Errorf("levels: unknown subsystem %q, must be one of: %s", name, strings.Join(subsystems, ", "))
+		}
+		var level slog.Level
+		err = level.UnmarshalText([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("levels[%q]: %w", name, err)
+		}
+		out[name] = level
+	}
+	return out, nil
+}
+
+// parseTopics parses the per-topic levels.
+func (lc *LogConfig) parseTopics() (out map[string]slog.Level, err error) {
+	out = map[string]slog.Level{}
+	for topic, s := range lc.Topics {
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			return nil, fmt.Errorf("topics[%q]: topic must be non-empty and not contain wildcards", topic)
+		}
+		var level slog.Level
+		err = level.UnmarshalText([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("topics[%q]: %w", topic, err)
+		}
+		out[topic] = level
+	}
+	return out, nil
+}
+
+// parseLogLevelsFlag parses a flag like "daikin=debug,history=warn" or "virt/daikin-ac/lounge=debug".
+func parseLogLevelsFlag(s string) (out map[string]string, err error) {
+	out = map[string]string{}
+	for part := range strings.SplitSeq(s, ",") {
+		if part == "" {
+			continue
+		}
+		name, level, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad log level %q, must be like \"name=debug\"", part)
+		}
+		out[name] = level
+	}
+	return out, nil
+}
+
+// setupLogging sets the output format and levels.
+// The format can only be set once, the first time this is called; levels are updated on every call.
+func setupLogging(lc LogConfig) {
+	setupLogOutput.Do(func() {
+		if !lc.JSON {
+			return
+		}
+		logRootLock.Lock()
+		defer logRootLock.Unlock()
+		logRoot = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	})
+
+	levels, err := lc.parseLevels()
+	if err != nil {
+		logConfig.Warn("ignoring bad log config", "err", err) // already validated
+		return
+	}
+	topics, err := lc.parseTopics()
+	if err != nil {
+		logConfig.Warn("ignoring bad log config", "err", err)
+		return
+	}
+
+	for name, level := range levels {
+		logLevels[name].Set(level)
+	}
+	logTopicLock.Lock()
+	logTopicLevels = topics
+	logTopicLock.Unlock()
+}
+
+var setupLogOutput sync.Once
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevelsFlag(t *testing.T) {
+	tests := []struct {
+		flag    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"daikin=debug,mqtt=warn", map[string]string{"daikin": "debug", "mqtt": "warn"}, false},
+		{"virt/daikin-ac/lounge=debug,", map[string]string{"virt/daikin-ac/lounge": "debug"}, false},
+		{"daikin", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLogLevelsFlag(tt.flag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("flag=%q err=%v, wantErr=%v", tt.flag, err, tt.wantErr)
+		} else if !tt.wantErr && !maps.Equal(got, tt.want) {
+			t.Errorf("flag=%q got=%v, want=%v", tt.flag, got, tt.want)
+		}
+	}
+}
+
+func TestLogConfigParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		lc      LogConfig
+		wantErr string
+	}{
+		{"empty", LogConfig{}, ""},
+		{"levels", LogConfig{Level: "warn", Levels: map[string]string{"daikin": "debug"}}, ""},
+		{"bad level", LogConfig{Level: "loud"}, "level:"},
+		{"unknown subsystem", LogConfig{Levels: map[string]string{"lounge": "debug"}}, "unknown subsystem"},
+		{"topics", LogConfig{Topics: map[string]string{"virt/daikin-ac/lounge": "debug"}}, ""},
+		{"wildcard topic", LogConfig{Topics: map[string]string{"virt/#": "debug"}}, "wildcards"},
+		{"bad topic level", LogConfig{Topics: map[string]string{"virt/x": "loud"}}, `topics["virt/x"]`},
+	}
+
+	for _, tt := range tests {
+		_, err := tt.lc.parseLevels()
+		if err == nil {
+			_, err = tt.lc.parseTopics()
+		}
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: got err=%v", tt.name, err)
+		} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err=%v, want containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLogTopicLevel(t *testing.T) {
+	var buf bytes.Buffer
+	prevRoot := logRoot
+	logRoot = slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	t.Cleanup(func() {
+		logRoot = prevRoot
+		setupLogging(LogConfig{})
+	})
+
+	setupLogging(LogConfig{
+		Levels: map[string]string{"device": "warn"},
+		Topics: map[string]string{"virt/loud": "debug", "virt/quiet": "error"},
+	})
+
+	topicLogger(logDevice, "virt/loud").Debug("loud debug")
+	topicLogger(logDevice, "virt/quiet").Warn("quiet warn")
+	topicLogger(logDevice, "virt/other").Info("other info")
+	topicLogger(logDevice, "virt/other").Warn("other warn")
+	topicLogger(logDevice, "virt/loud").With("k", "v").Debug("loud with")
+
+	// packages like api/daikin log with the handler's context
+	ctx := withLogTopic(context.Background(), "virt/loud")
+	newLogger("daikin").DebugContext(ctx, "daikin debug")
+	newLogger("daikin").Debug("daikin no topic")
+
+	got := buf.String()
+	for _, want := range []string{"msg=\"loud debug\" sys=device topic=virt/loud", "other warn", "msg=\"loud with\" sys=device topic=virt/loud k=v", "daikin debug"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	for _, notWant := range []string{"quiet warn", "other info", "daikin no topic"} {
+		if strings.Contains(got, notWant) {
+			t.Errorf("unexpected %q in:\n%s", notWant, got)
+		}
+	}
+}
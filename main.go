@@ -2,17 +2,16 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
-	"fmt"
-	"log"
+	"net"
+	"net/http"
 	"os"
-	"path"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/eclipse/paho.golang/paho"
-	"github.com/samthor/gohaus/api/daikin"
 	"github.com/samthor/gohaus/api/powerwall"
+	"github.com/samthor/gohaus/history"
 )
 
 var (
@@ -20,126 +19,208 @@ var (
 	flagURL             = flag.String("url", "mqtt://mqtt.haus.samthor.au:1883", "mqtt url to connect to")
 	flagTeslaSecret     = flag.String("gw_pw", "", "Powerwall secret")
 	flagStandardHistory = flag.Duration("history_every", time.Second*30, "Standard time to fetch logs")
-)
-
-var (
-	daikinDevices = map[string]daikin.Device{
-		"den":         {Host: "192.168.3.146"},
-		"living-room": {Host: "192.168.3.152"},
-		"bedroom":     {Host: "192.168.3.204"},
-		"loft":        {Host: "192.168.3.225"},
-		"office":      {Host: "192.168.3.245", UUID: "f45aab28604811eca7c4737954d1686f"},
-	}
+	flagHistoryFormat   = flag.String("history_format", "jsonl", "format to write history in: jsonl, or bin for a compact binary format")
+	flagConfig          = flag.String("config", "", "path to JSON config of devices and history")
+	flagMQTTUser        = flag.String("mqtt_user", "", "mqtt username (also via url or $MQTT_USERNAME)")
+	flagMQTTPass        = flag.String("mqtt_pass", "", "mqtt password (also via url or $MQTT_PASSWORD)")
+	flagMQTTCA          = flag.String("mqtt_ca", "", "path to PEM CA bundle for mqtts:// or wss://")
+	flagMQTTCert        = flag.String("mqtt_cert", "", "path to PEM client certificate")
+	flagMQTTKey         = flag.String("mqtt_key", "", "path to PEM client key")
+	flagLogJSON         = flag.Bool("log_json", false, "log as JSON")
+	flagLogLevel        = flag.String("log_level", "info", "log level: debug, info, warn or error")
+	flagLogLevels       = flag.String("log_levels", "", "per-subsystem log levels, e.g. \"daikin=debug,mqtt=warn\"")
+	flagLogTopics       = flag.String("log_topics", "", "per-topic log levels for devices and history, e.g. \"virt/daikin-ac/lounge=debug\"")
+	flagStaleAfter      = flag.Duration("stale_after", 0, "if non-zero, devices and history without data for this long are unhealthy (also per device or history topic in the config)")
+	flagHTTP            = flag.String("http", "", "if specified, address to serve HTTP on (e.g., \":8080\"), for /metrics, /devices, /history, /ws, /healthz and /readyz")
 )
 
 func main() {
 	flag.Parse()
 	var err error
 
-	pw, err := connectToPaho(context.Background(), *flagURL)
+	cfg, err := loadConfig(*flagConfig)
+	if err != nil {
+		fatal("could not load config", "err", err)
+	}
+	setupLogging(cfg.Log)
+
+	pw, err := connectToPaho(context.Background(), cfg.MQTT)
 	if err != nil {
-		log.Fatalf("could not connectToPaho url=%v err=%v", *flagURL, err)
+		fatal("could not connect to MQTT", "err", err)
 	}
 
 	// need to subscribe to all (ugh) for router to actually route
-	_, err = pw.c.Subscribe(context.Background(), &paho.Subscribe{
-		Subscriptions: []paho.SubscribeOptions{
-			{Topic: "#"},
-		},
-	})
+	err = pw.subscribe("#", 0)
 	if err != nil {
-		log.Fatalf("could not subscribe to all: %v", err)
+		logMQTT.Warn("could not subscribe to all, will retry on reconnect", "err", err)
 	}
 
-	configHistory(pw)
-	configDevices(pw)
-	<-make(chan bool) // sleep forever
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-func writePacket(packet HistoryPacket) (err error) {
-	enc := encodeTopic(packet.Topic)
+	historyQ, historyDone := configHistory(cfg.HistoryFiles, cfg.LineSink)
 
-	p := path.Join(*flagHistoryPath, enc)
+	h := newHouse(ctx, pw, historyQ)
+	h.apply(cfg)
 
-	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0660)
+	if *flagConfig != "" {
+		go watchConfig(ctx, *flagConfig, h)
+	}
+
+	if cfg.HTTP != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /metrics", serveMetrics)
+		mux.HandleFunc("GET /devices", handleDevices)
+		mux.HandleFunc("GET /devices/{topic...}", handleDeviceGet)
+		mux.HandleFunc("POST /devices/{topic...}", handleDevicePost)
+		mux.HandleFunc("GET /ws", wsHandler(ctx))
+		mux.HandleFunc("GET /healthz", handleHealthz)
+		mux.HandleFunc("GET /readyz", readyHandler(pw))
+		if *flagHistoryPath != "" {
+			mux.HandleFunc("GET /history/{topic...}", handleHistoryQuery(*flagHistoryPath))
+		}
+
+		err = serveHTTP(ctx, cfg.HTTP, mux)
+		if err != nil {
+			fatal("could not serve HTTP", "err", err)
+		}
+	}
+
+	<-ctx.Done()
+	stop() // a second signal kills us
+	logMain.Info("shutting down")
+
+	h.stop()
+	if historyQ != nil {
+		historyQ.close()
+		<-historyDone
+	}
+
+	disconnectCtx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	err = pw.disconnect(disconnectCtx)
 	if err != nil {
-		return err
+		logMQTT.Warn("could not disconnect cleanly", "err", err)
 	}
-	defer f.Close()
+}
 
-	b, err := json.Marshal(packet)
+// serveHTTP listens on addr and serves handler in the background, until ctx is done.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	b = append(b, '\n')
+	logHTTP.Info("serving HTTP", "addr", l.Addr())
+
+	s := &http.Server{Handler: handler}
+	go func() {
+		err := s.Serve(l)
+		if err != http.ErrServerClosed {
+			logHTTP.Error("HTTP server stopped", "err", err)
+		}
+	}()
+	context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer cancel()
+		s.Shutdown(shutdownCtx)
+	})
 
-	_, err = f.Write(b)
-	return err
+	return nil
 }
 
-func configHistory(pw *pahoWrap) {
-	if *flagHistoryPath == "" {
-		log.Printf("not running history")
-		return
+// configHistory starts the history writer and line sink, returning nil if neither is enabled.
+// The writer drains the queue until it is closed, and then closes done.
+func configHistory(hc HistoryFilesConfig, lc LineSinkConfig) (q *historyQueue, done <-chan struct{}) {
+	if *flagHistoryPath == "" && !lc.enabled() {
+		logHistory.Info("not running history")
+		return nil, nil
+	}
+
+	var w *history.Writer
+	var err error
+	if *flagHistoryPath != "" {
+		logHistory.Info("writing history", "path", *flagHistoryPath)
+		w, err = history.NewWriter(hc.options(*flagHistoryPath))
+		if err != nil {
+			fatal("could not start history", "err", err)
+		}
+	}
+
+	var sink *lineSink
+	if lc.enabled() {
+		logHistory.Info("sending history as line protocol", "file", lc.File, "url", lc.URL)
+		sink, err = newLineSink(lc)
+		if err != nil {
+			fatal("could not start line sink", "err", err)
+		}
 	}
-	log.Printf("writing history to: %v", *flagHistoryPath)
 
-	ch := make(chan HistoryPacket)
+	q = newHistoryQueue(hc.QueueSize, historyDropPolicy(hc.DropPolicy))
+	writerDone := make(chan struct{})
 	go func() {
-		os.MkdirAll(*flagHistoryPath, 0775)
+		defer close(writerDone)
+
+		drainHistory(q, w, sink, time.Duration(hc.LateAfter))
 
-		for packet := range ch {
-			err := writePacket(packet)
+		if w != nil {
+			err := w.Close()
 			if err != nil {
-				log.Fatalf("could not write packet=%+v: %v", packet, err)
+				logHistory.Warn("could not close history", "err", err)
+			}
+		}
+		if sink != nil {
+			err := sink.close()
+			if err != nil {
+				logHistory.Warn("could not close line sink", "err", err)
 			}
 		}
 	}()
 
-	d := *flagStandardHistory
-
-	for daikinID := range daikinDevices {
-		History(&HistoryReq{Paho: pw, Topic: fmt.Sprintf("virt/daikin-ac/%s", daikinID), MinDuration: d * 2, Ch: ch})
-	}
-
-	History(&HistoryReq{Paho: pw, Topic: "virt/powerwall", MinDuration: d, Ch: ch})
-	History(&HistoryReq{Paho: pw, Topic: "zigbee2mqtt/device/power/rack", MinDuration: d, Ch: ch, GetKey: "power"})
-	History(&HistoryReq{Paho: pw, Topic: "zigbee2mqtt/device/sensor/noc-etc", MinDuration: d, Ch: ch, GetKey: "temperature"})
-	History(&HistoryReq{Paho: pw, Topic: "zigbee2mqtt/device/sensor/whatever", MinDuration: d, Ch: ch, GetKey: "-"})
-
+	return q, writerDone
 }
 
-func configDevices(pw *pahoWrap) {
+// configDevices returns the virtual devices described by the config.
+func configDevices(ctx context.Context, pw *pahoWrap, cfg *Config) (out map[string]startSpec) {
+	out = map[string]startSpec{}
 
 	// -- daikin ACs
 
-	for daikinID, device := range daikinDevices {
-		Register(pw, fmt.Sprintf("virt/daikin-ac/%s", daikinID), device.Run)
+	for daikinID, device := range cfg.Daikin {
+		topic := daikinTopic(daikinID)
+		spec := startSpec{key: device, start: func() func() { return Register(ctx, pw, topic, device.options(), device.Run) }}
+		out[topic] = withDiscovery(pw, cfg.DiscoveryPrefix, spec, daikinDiscovery(pw, topic, daikinID))
 	}
 
 	// -- battery
 
-	if *flagTeslaSecret != "" {
-		td := &powerwall.TEDApi{Secret: *flagTeslaSecret}
-
-		runner := func(ctx context.Context, readSet func() (out *struct{})) (powerwall.SimpleStatus, error) {
-			readSet()
-			status, err := powerwall.GetSimpleStatus(ctx, td)
-			if err != nil {
-				return powerwall.SimpleStatus{}, err
+	if pc := cfg.Powerwall; pc != nil {
+		start := func() func() {
+			td := &powerwall.TEDApi{Secret: pc.Secret, Host: pc.Host, DIN: pc.DIN}
+
+			runner := func(ctx context.Context, readSet func() (out *struct{})) (powerwall.SimpleStatus, error) {
+				readSet()
+				status, err := powerwall.GetSimpleStatus(ctx, td)
+				if err != nil {
+					return powerwall.SimpleStatus{}, err
+				}
+				return *status, nil
 			}
-			return *status, nil
+			return Register(ctx, pw, "virt/powerwall", pc.options(), runner)
 		}
-		Register(pw, "virt/powerwall", runner)
+		spec := startSpec{key: *pc, start: start}
+		out["virt/powerwall"] = withDiscovery(pw, cfg.DiscoveryPrefix, spec, powerwallDiscovery(pw, "virt/powerwall"))
 	}
 
 	// -- virtual day/night
 
-	Register(pw, "virt/earth3", func(ctx context.Context, readSet func() (out *struct{})) (EarthValues, error) {
-		readSet()
-		return EarthValues{}, nil // TODO
-	})
+	out["virt/earth3"] = startSpec{start: func() func() {
+		return Register(ctx, pw, "virt/earth3", nil, func(ctx context.Context, readSet func() (out *struct{})) (EarthValues, error) {
+			readSet()
+			return EarthValues{}, nil // TODO
+		})
+	}}
 
+	return out
 }
 
 type EarthValues struct {
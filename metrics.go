@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	metricHandlerSeconds = newHistogram("gohaus_handler_duration_seconds", "Time taken by device handlers.", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20}, "topic")
+	metricHandlerErrors  = newCounter("gohaus_handler_errors_total", "Device handler failures.", "topic")
+	metricSets           = newCounter("gohaus_sets_total", "Outcomes of \"/set\" requests, including those rejected as invalid.", "topic", "result")
+	metricState          = newGauge("gohaus_state", "Latest numeric and boolean values announced by devices.", "topic", "key")
+
+	metricMQTTConnected = newGauge("gohaus_mqtt_connected", "Whether connected to the MQTT broker.")
+	metricMQTTErrors    = newCounter("gohaus_mqtt_errors_total", "Failed MQTT operations.")
+
+	metricHistoryWritten     = newCounter("gohaus_history_written_total", "History packets written.", "topic")
+	metricHistoryDropped     = newCounter("gohaus_history_dropped_total", "History packets not written, as they arrived too soon, were unchanged within their deadband, were invalid, overflowed the queue, or failed to write repeatedly or on shutdown. Only overflow and failed are by concrete topic; the rest are by configured topic, which may be a wildcard.", "topic", "reason")
+	metricHistoryLate        = newCounter("gohaus_history_late_total", "History packets written long after they arrived, as the writer was slow or failing.", "topic")
+	metricHistoryWriteErrors = newCounter("gohaus_history_write_errors_total", "Failed attempts to write history, which are retried.")
+
+	metricLineSinkErrors  = newCounter("gohaus_line_sink_errors_total", "Failed writes of history to the line protocol sink.")
+	metricLineSinkDropped = newCounter("gohaus_line_sink_dropped_total", "History packets not sent to the line protocol sink, as its buffer was full.")
+)
+
+// allMetrics is every metric, in the order they were created.
+var allMetrics []*metric
+
+// metric is a Prometheus counter, gauge or histogram, with any number of labels.
+type metric struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64      // histogram only
+	fn               func() float64 // if set, the value of a metric without labels
+
+	lock   sync.Mutex
+	series map[string]*metricSeries // by labelKey
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64  // counter and gauge; sum for histogram
+	counts []uint64 // histogram only, per bucket (not cumulative)
+	count  uint64   // histogram only
+}
+
+func newMetric(name, help, kind string, labels []string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, series: map[string]*metricSeries{}}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric(name, help, "counter", labels)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return newMetric(name, help, "gauge", labels)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric(name, help, "histogram", labels)
+	m.buckets = buckets
+	return m
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// get returns the series for the given label values, creating it if needed.
+// Must be called with lock held.
+func (m *metric) get(values []string) *metricSeries {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s wants %d labels, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := labelKey(values)
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: values}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(delta float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(values).value += delta
+}
+
+func (m *metric) set(v float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(values).value = v
+}
+
+// setFunc makes this metric, which must not have labels, report the result of fn.
+func (m *metric) setFunc(fn func() float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.fn = fn
+}
+
+func (m *metric) observe(v float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s := m.get(values)
+	s.value += v
+	s.count++
+	if i, _ := slices.BinarySearch(m.buckets, v); i < len(m.buckets) {
+		s.counts[i]++
+	}
+}
+
+// replace replaces all series whose first label is first, with one series per entry of values keyed by the second label.
+func (m *metric) replace(first string, values map[string]float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.forgetLocked(first)
+	for second, v := range values {
+		m.get([]string{first, second}).value = v
+	}
+}
+
+// forget removes all series whose first label is first.
+func (m *metric) forget(first string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.forgetLocked(first)
+}
+
+func (m *metric) forgetLocked(first string) {
+	for key, s := range m.series {
+		if s.labels[0] == first {
+			delete(m.series, key)
+		}
+	}
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders labels as `{a="x",b="y"}`, adding the extra name/value pair if not empty.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, metricLabelEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("{%s}", strings.Join(parts, ","))
+}
+
+// write writes this metric in the Prometheus text format.
+func (m *metric) write(w *bufio.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	if m.fn != nil {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatMetricValue(m.fn()))
+		return
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(m.series)) {
+		s := m.series[key]
+		if m.buckets == nil {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labels, "", ""), formatMetricValue(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", formatMetricValue(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labels, "", ""), formatMetricValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labels, "", ""), s.count)
+	}
+}
+
+// serveMetrics serves all metrics in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	for _, m := range allMetrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"maps"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestMetric returns a metric which isn't served by serveMetrics.
+func newTestMetric(kind string, buckets []float64, labels ...string) *metric {
+	return &metric{name: "test_metric", help: "Test.", kind: kind, labels: labels, buckets: buckets, series: map[string]*metricSeries{}}
+}
+
+func writeMetric(m *metric) string {
+	var sb strings.Builder
+	bw := bufio.NewWriter(&sb)
+	m.write(bw)
+	bw.Flush()
+	return sb.String()
+}
+
+func TestMetricWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric func() *metric
+		want   string
+	}{
+		{
+			name: "counter",
+			metric: func() *metric {
+				m := newTestMetric("counter", nil, "topic", "result")
+				m.add(1, "b", "success")
+				m.add(2, "a", "error")
+				m.add(1, "a", "error")
+				return m
+			},
+			want: `# HELP test_metric Test.
+# TYPE test_metric counter
+test_metric{topic="a",result="error"} 3
+test_metric{topic="b",result="success"} 1
+`,
+		},
+		{
+			name: "escaped labels",
+			metric: func() *metric {
+				m := newTestMetric("gauge", nil, "topic")
+				m.set(0.5, "a\"b\\c\nd")
+				return m
+			},
+			want: `# HELP test_metric Test.
+# TYPE test_metric gauge
+test_metric{topic="a\"b\\c\nd"} 0.5
+`,
+		},
+		{
+			name: "func",
+			metric: func() *metric {
+				m := newTestMetric("gauge", nil)
+				m.setFunc(func() float64 { return 1 })
+				return m
+			},
+			want: `# HELP test_metric Test.
+# TYPE test_metric gauge
+test_metric 1
+`,
+		},
+		{
+			name: "histogram",
+			metric: func() *metric {
+				m := newTestMetric("histogram", []float64{0.1, 1}, "topic")
+				m.observe(0.05, "a")
+				m.observe(0.1, "a")
+				m.observe(0.5, "a")
+				m.observe(2, "a")
+				return m
+			},
+			want: `# HELP test_metric Test.
+# TYPE test_metric histogram
+test_metric_bucket{topic="a",le="0.1"} 2
+test_metric_bucket{topic="a",le="1"} 3
+test_metric_bucket{topic="a",le="+Inf"} 4
+test_metric_sum{topic="a"} 2.65
+test_metric_count{topic="a"} 4
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := writeMetric(tt.metric())
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricReplace(t *testing.T) {
+	m := newTestMetric("gauge", nil, "topic", "key")
+	m.replace("a", map[string]float64{"x": 1, "y": 2})
+	m.replace("b", map[string]float64{"x": 3})
+	m.replace("a", map[string]float64{"z": 4})
+	m.forget("b")
+
+	want := `# HELP test_metric Test.
+# TYPE test_metric gauge
+test_metric{topic="a",key="z"} 4
+`
+	if got := writeMetric(m); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStateMetrics(t *testing.T) {
+	got := stateMetrics([]byte(`{"power":true,"setTemp":21.5,"mode":"cool","nested":{"a":1},"off":false}`))
+	want := map[string]float64{"power": 1, "setTemp": 21.5, "off": 0}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := stateMetrics([]byte(`[1,2]`)); len(got) != 0 {
+		t.Errorf("got %v for non-object, want none", got)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "# TYPE gohaus_mqtt_connected gauge\n") {
+		t.Errorf("missing gohaus_mqtt_connected in:\n%s", w.Body.String())
+	}
+}
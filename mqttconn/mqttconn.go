@@ -0,0 +1,96 @@
+// Package mqttconn holds how to connect to an MQTT broker, shared by gohaus and its tools.
+package mqttconn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/eclipse/paho.golang/autopaho"
+)
+
+// Options describes a broker and how to authenticate to it.
+type Options struct {
+	URL      string `json:"url"`      // mqtt://, mqtts://, ssl://, ws:// or wss://
+	Username string `json:"username"` // falls back to URL userinfo or $MQTT_USERNAME
+	Password string `json:"password"` // falls back to URL userinfo or $MQTT_PASSWORD
+	CA       string `json:"ca"`       // path to PEM bundle of CAs to trust instead of the system pool
+	Cert     string `json:"cert"`     // path to PEM client certificate
+	Key      string `json:"key"`      // path to PEM client key
+}
+
+// Credentials returns the username and password to connect with.
+// Those set explicitly win over those in the URL, which win over the environment.
+func (o *Options) Credentials() (username, password string) {
+	username, password = o.Username, o.Password
+
+	u, err := url.Parse(o.URL)
+	if err == nil && u.User != nil {
+		if username == "" {
+			username = u.User.Username()
+		}
+		if p, ok := u.User.Password(); ok && password == "" {
+			password = p
+		}
+	}
+
+	if username == "" {
+		username = os.Getenv("MQTT_USERNAME")
+	}
+	if password == "" {
+		password = os.Getenv("MQTT_PASSWORD")
+	}
+	return username, password
+}
+
+// TLSConfig returns the TLS config to use for secure connections, or nil to use the defaults.
+func (o *Options) TLSConfig() (*tls.Config, error) {
+	if o.CA == "" && o.Cert == "" {
+		return nil, nil
+	}
+	out := &tls.Config{}
+
+	if o.CA != "" {
+		b, err := os.ReadFile(o.CA)
+		if err != nil {
+			return nil, err
+		}
+		out.RootCAs = x509.NewCertPool()
+		if !out.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in ca=%v", o.CA)
+		}
+	}
+
+	if o.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		out.Certificates = []tls.Certificate{cert}
+	}
+
+	return out, nil
+}
+
+// ClientConfig returns a config to connect to the broker, to which the caller adds everything else.
+// Credentials are sent in the CONNECT packet, not via the URL.
+func (o *Options) ClientConfig() (cfg autopaho.ClientConfig, err error) {
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return cfg, err
+	}
+	u.User = nil
+
+	cfg.TlsCfg, err = o.TLSConfig()
+	if err != nil {
+		return cfg, err
+	}
+	username, password := o.Credentials()
+
+	cfg.ServerUrls = []*url.URL{u}
+	cfg.ConnectUsername = username
+	cfg.ConnectPassword = []byte(password)
+	return cfg, nil
+}
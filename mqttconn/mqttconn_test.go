@@ -0,0 +1,48 @@
+package mqttconn
+
+import "testing"
+
+func TestCredentials(t *testing.T) {
+	t.Setenv("MQTT_USERNAME", "env-user")
+	t.Setenv("MQTT_PASSWORD", "env-pass")
+
+	tests := []struct {
+		name       string
+		o          Options
+		user, pass string
+	}{
+		{"env", Options{URL: "mqtt://localhost"}, "env-user", "env-pass"},
+		{"url", Options{URL: "mqtt://u:p@localhost"}, "u", "p"},
+		{"url user only", Options{URL: "mqtt://u@localhost"}, "u", "env-pass"},
+		{"explicit", Options{URL: "mqtt://u:p@localhost", Username: "x", Password: "y"}, "x", "y"},
+	}
+
+	for _, tt := range tests {
+		user, pass := tt.o.Credentials()
+		if user != tt.user || pass != tt.pass {
+			t.Errorf("%s: got %q/%q, want %q/%q", tt.name, user, pass, tt.user, tt.pass)
+		}
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	o := Options{URL: "mqtts://u:p@localhost:8883"}
+	cfg, err := o.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.ServerUrls) != 1 || cfg.ServerUrls[0].String() != "mqtts://localhost:8883" {
+		t.Errorf("urls=%v, want credentials removed", cfg.ServerUrls)
+	}
+	if cfg.ConnectUsername != "u" || string(cfg.ConnectPassword) != "p" {
+		t.Errorf("got %q/%q, want u/p", cfg.ConnectUsername, cfg.ConnectPassword)
+	}
+	if cfg.TlsCfg != nil {
+		t.Errorf("expected default TLS config")
+	}
+
+	o.CA = "/does/not/exist.pem"
+	if _, err := o.ClientConfig(); err == nil {
+		t.Errorf("expected error for missing CA")
+	}
+}
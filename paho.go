@@ -3,22 +3,171 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"math/rand/v2"
-	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 )
 
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
 type pahoWrap struct {
 	c      *autopaho.ConnectionManager
 	router *paho.StandardRouter
 	ctx    context.Context
+
+	availabilityTopic string
+
+	connected atomic.Bool
+	errors    atomic.Int64 // count of failed MQTT operations
+
+	lock   sync.Mutex
+	topics map[string]*routeTopic
+	subs   map[string]byte // topic filter to QoS, resubscribed on reconnect
+}
+
+// routeTopic holds the handlers for a single topic filter.
+// It has its own lock as the router holds its own lock while dispatching.
+type routeTopic struct {
+	lock     sync.Mutex
+	handlers []*routeHandler
+}
+
+type routeHandler struct {
+	h paho.MessageHandler
+}
+
+func (rt *routeTopic) dispatch(p *paho.Publish) {
+	rt.lock.Lock()
+	all := rt.handlers
+	rt.lock.Unlock()
+
+	for _, rh := range all {
+		rh.h(p)
+	}
+}
+
+// handle registers a handler for the given topic filter.
+// Unlike the router, handlers for the same filter can be removed individually via the returned func.
+func (pw *pahoWrap) handle(topic string, h paho.MessageHandler) (remove func()) {
+	rh := &routeHandler{h: h}
+
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+
+	rt := pw.topics[topic]
+	if rt == nil {
+		rt = &routeTopic{}
+		pw.topics[topic] = rt
+		pw.router.RegisterHandler(topic, rt.dispatch)
+	}
+
+	rt.lock.Lock()
+	rt.handlers = append(rt.handlers, rh)
+	rt.lock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pw.lock.Lock()
+			defer pw.lock.Unlock()
+
+			rt.lock.Lock()
+			rt.handlers = slices.DeleteFunc(slices.Clone(rt.handlers), func(each *routeHandler) bool { return each == rh })
+			empty := len(rt.handlers) == 0
+			rt.lock.Unlock()
+
+			if empty {
+				delete(pw.topics, topic)
+				pw.router.UnregisterHandler(topic)
+			}
+		})
+	}
+}
+
+// subscribe subscribes to the given topic filter, and remembers it so it is resubscribed on reconnect.
+// Failure is returned but the subscription is still retried on the next reconnect.
+func (pw *pahoWrap) subscribe(topic string, qos byte) error {
+	pw.lock.Lock()
+	pw.subs[topic] = qos
+	pw.lock.Unlock()
+
+	_, err := pw.c.Subscribe(pw.ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: topic, QoS: qos},
+		},
+	})
+	if err != nil {
+		pw.errors.Add(1)
+		return fmt.Errorf("could not subscribe to topic=%v: %w", topic, err)
+	}
+	return nil
 }
 
-func connectToPaho(ctx context.Context, rawURL string) (*pahoWrap, error) {
-	u, err := url.Parse(rawURL)
+// unsubscribe reverses a prior call to subscribe.
+func (pw *pahoWrap) unsubscribe(topic string) error {
+	pw.lock.Lock()
+	delete(pw.subs, topic)
+	pw.lock.Unlock()
+
+	_, err := pw.c.Unsubscribe(pw.ctx, &paho.Unsubscribe{Topics: []string{topic}})
+	if err != nil {
+		pw.errors.Add(1)
+		return fmt.Errorf("could not unsubscribe from topic=%v: %w", topic, err)
+	}
+	return nil
+}
+
+// resubscribe subscribes again to every topic passed to subscribe, as the session does not survive reconnects.
+func (pw *pahoWrap) resubscribe(cm *autopaho.ConnectionManager) {
+	pw.lock.Lock()
+	var opts []paho.SubscribeOptions
+	for topic, qos := range pw.subs {
+		opts = append(opts, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	pw.lock.Unlock()
+
+	if len(opts) == 0 {
+		return
+	}
+	_, err := cm.Subscribe(pw.ctx, &paho.Subscribe{Subscriptions: opts})
+	if err != nil {
+		pw.errors.Add(1)
+		logMQTT.Warn("could not resubscribe", "topics", len(opts), "err", err)
+	}
+}
+
+// publish publishes the given packet, counting any failure.
+func (pw *pahoWrap) publish(p *paho.Publish) error {
+	_, err := pw.c.Publish(pw.ctx, p)
+	if err != nil {
+		pw.errors.Add(1)
+		return fmt.Errorf("could not publish to topic=%v: %w", p.Topic, err)
+	}
+	return nil
+}
+
+// disconnect marks the bridge as offline and cleanly disconnects.
+func (pw *pahoWrap) disconnect(ctx context.Context) error {
+	err := pw.publish(&paho.Publish{Topic: pw.availabilityTopic, Payload: []byte(availabilityOffline), QoS: 1, Retain: true})
+	if err != nil {
+		logMQTT.Warn("could not mark bridge offline", "err", err)
+	}
+	return pw.c.Disconnect(ctx)
+}
+
+// connectToPaho connects to the given broker, waiting until the first connection succeeds.
+// Connection errors are logged and the connection is retried forever; once connected, the connection is re-established if lost.
+// Credentials are sent in the CONNECT packet, not via the URL.
+// The bridge's availability topic is set to "online" on connect, and "offline" via a will message.
+func connectToPaho(ctx context.Context, mc MQTTConfig) (*pahoWrap, error) {
+	base, err := mc.ClientConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -26,15 +175,57 @@ func connectToPaho(ctx context.Context, rawURL string) (*pahoWrap, error) {
 	router := paho.NewStandardRouter()
 	//	router.SetDebugLogger(log.Default())
 
+	pw := &pahoWrap{
+		router:            router,
+		ctx:               ctx,
+		availabilityTopic: mc.availabilityTopic(),
+		topics:            map[string]*routeTopic{},
+		subs:              map[string]byte{},
+	}
+
+	metricMQTTConnected.setFunc(func() float64 {
+		if pw.connected.Load() {
+			return 1
+		}
+		return 0
+	})
+	metricMQTTErrors.setFunc(func() float64 { return float64(pw.errors.Load()) })
+
+	connectionDown := func() {
+		if pw.connected.Swap(false) {
+			logMQTT.Warn("connection down, will reconnect")
+		}
+	}
+
 	cliCfg := autopaho.ClientConfig{
-		ServerUrls: []*url.URL{u},
+		ServerUrls: base.ServerUrls,
+		TlsCfg:     base.TlsCfg,
+
+		ConnectUsername: base.ConnectUsername,
+		ConnectPassword: base.ConnectPassword,
 
 		OnConnectError: func(err error) {
-			log.Fatalf("could not connect: %v", err)
+			pw.errors.Add(1)
+			logMQTT.Warn("could not connect", "err", err)
 		},
 
 		OnConnectionUp: func(cm *autopaho.ConnectionManager, c *paho.Connack) {
-			log.Printf("mqtt connection up")
+			logMQTT.Info("connection up")
+			pw.connected.Store(true)
+			pw.resubscribe(cm)
+
+			_, err := cm.Publish(ctx, &paho.Publish{Topic: pw.availabilityTopic, Payload: []byte(availabilityOnline), QoS: 1, Retain: true})
+			if err != nil {
+				pw.errors.Add(1)
+				logMQTT.Warn("could not mark bridge online", "err", err)
+			}
+		},
+
+		WillMessage: &paho.WillMessage{
+			Topic:   pw.availabilityTopic,
+			Payload: []byte(availabilityOffline),
+			QoS:     1,
+			Retain:  true,
 		},
 
 		KeepAlive: 10,
@@ -50,26 +241,29 @@ func connectToPaho(ctx context.Context, rawURL string) (*pahoWrap, error) {
 				},
 			},
 			OnClientError: func(err error) {
-				log.Fatalf("got client err: %v", err)
+				pw.errors.Add(1)
+				logMQTT.Warn("client error", "err", err)
+				connectionDown()
 			},
 			OnServerDisconnect: func(d *paho.Disconnect) {
-				log.Fatalf("disconnect: str=%v code=%v", d.Properties.ReasonString, d.ReasonCode)
+				var reason string
+				if d.Properties != nil {
+					reason = d.Properties.ReasonString
+				}
+				logMQTT.Warn("disconnected by server", "reason", reason, "code", d.ReasonCode)
+				connectionDown()
 			},
 		},
 	}
 
-	c, err := autopaho.NewConnection(ctx, cliCfg) // starts process; will reconnect until context cancelled
+	pw.c, err = autopaho.NewConnection(ctx, cliCfg) // starts process; will reconnect until context cancelled
 	if err != nil {
 		return nil, err
 	}
 
-	if err = c.AwaitConnection(ctx); err != nil {
+	if err = pw.c.AwaitConnection(ctx); err != nil {
 		return nil, err
 	}
 
-	return &pahoWrap{
-		c:      c,
-		router: router,
-		ctx:    ctx,
-	}, nil
+	return pw, nil
 }
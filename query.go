@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/samthor/gohaus/history"
+)
+
+const (
+	defaultQueryRange = time.Hour * 24
+)
+
+type queryResponse struct {
+	Topic  string           `json:"topic"`
+	From   time.Time        `json:"from"`
+	To     time.Time        `json:"to"`
+	Bucket float64          `json:"bucket"` // in seconds
+	Series []history.Series `json:"series"`
+}
+
+// handleHistoryQuery handles `GET /history/{topic...}`, returning aggregated series from the history in dir.
+//
+// Query parameters are all optional:
+//   - key: keys to return, repeated or comma-separated, default all
+//   - from, to: RFC 3339 or unix seconds, default the last 24 hours
+//   - bucket: a duration like "5m", default a single bucket for the whole range
+func handleHistoryQuery(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		series, err := q.Run(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "no history for topic", http.StatusNotFound)
+			return
+		} else if errors.Is(err, history.ErrBadQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logHistory.Warn("could not query history", "topic", q.Topic, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, queryResponse{
+			Topic:  q.Topic,
+			From:   q.From,
+			To:     q.To,
+			Bucket: q.Bucket.Seconds(),
+			Series: series,
+		})
+	}
+}
+
+func parseQuery(r *http.Request) (q history.Query, err error) {
+	values := r.URL.Query()
+	q.Topic = r.PathValue("topic")
+
+	for _, k := range values["key"] {
+		for k := range strings.SplitSeq(k, ",") {
+			if k != "" {
+				q.Keys = append(q.Keys, k)
+			}
+		}
+	}
+
+	q.To = time.Now()
+	if s := values.Get("to"); s != "" {
+		q.To, err = history.ParseTime(s)
+		if err != nil {
+			return q, fmt.Errorf("bad to: %w", err)
+		}
+	}
+	q.From = q.To.Add(-defaultQueryRange)
+	if s := values.Get("from"); s != "" {
+		q.From, err = history.ParseTime(s)
+		if err != nil {
+			return q, fmt.Errorf("bad from: %w", err)
+		}
+	}
+	if s := values.Get("bucket"); s != "" {
+		q.Bucket, err = time.ParseDuration(s)
+		if err != nil {
+			return q, fmt.Errorf("bad bucket: %w", err)
+		}
+	}
+
+	return q, nil
+}
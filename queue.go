@@ -0,0 +1,234 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samthor/gohaus/history"
+)
+
+const (
+	defaultHistoryQueueSize = 10_000
+	defaultHistoryLateAfter = time.Minute
+	maxHistoryBatch         = 500
+	minHistoryRetry         = time.Second
+	maxHistoryRetry         = time.Second * 30
+	maxHistoryAttempts      = 10 // after this many failed attempts in a row, a topic's pending packets are dropped
+)
+
+var (
+	// historyBacklog is the number of packets queued to be written, but not yet written.
+	historyBacklog atomic.Int64
+
+	// historyWriteErr is the error of the last failed write, or "" once writes succeed again.
+	historyWriteErr atomic.Value
+)
+
+// historyDropPolicy says which packet is dropped when the queue is full.
+type historyDropPolicy string
+
+const (
+	dropOldest historyDropPolicy = "oldest" // the default, so history stays current
+	dropNewest historyDropPolicy = "newest"
+)
+
+// historyQueue is a bounded queue of packets to be written, so that recording history never blocks on the disk.
+// When full, packets are dropped per its policy.
+type historyQueue struct {
+	size   int
+	policy historyDropPolicy
+
+	lock    sync.Mutex
+	packets []history.Packet
+	closed  bool
+	wake    chan struct{} // signalled on push and close
+	done    chan struct{} // closed on close
+}
+
+func newHistoryQueue(size int, policy historyDropPolicy) *historyQueue {
+	if size <= 0 {
+		size = defaultHistoryQueueSize
+	}
+	if policy == "" {
+		policy = dropOldest
+	}
+	return &historyQueue{size: size, policy: policy, wake: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// push queues the packet without blocking. Packets pushed after close are ignored.
+func (q *historyQueue) push(p history.Packet) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	if len(q.packets) >= q.size {
+		drop := p
+		if q.policy == dropOldest {
+			drop = q.packets[0]
+			q.packets = q.packets[1:]
+		}
+		metricHistoryDropped.add(1, drop.Topic, "overflow")
+		if q.policy == dropNewest {
+			return
+		}
+	} else {
+		historyBacklog.Add(1)
+	}
+	q.packets = append(q.packets, p)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for and returns up to limit packets, or nil once the queue is closed and empty.
+func (q *historyQueue) pop(limit int) []history.Packet {
+	for {
+		out, closed := q.popNow(limit)
+		if len(out) != 0 {
+			return out
+		} else if closed {
+			return nil
+		}
+		<-q.wake
+	}
+}
+
+// popNow returns up to limit packets without waiting, and whether the queue is closed.
+func (q *historyQueue) popNow(limit int) (out []history.Packet, closed bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n := min(len(q.packets), limit)
+	out = q.packets[:n:n]
+	q.packets = q.packets[n:]
+	return out, q.closed
+}
+
+// close stops accepting packets. Those already queued can still be popped.
+func (q *historyQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.done)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drainHistory writes packets from q in batches to w and sink, either of which may be nil, until q is closed and empty.
+// If writing a topic fails, e.g., as the disk is full, its packets are retried with backoff alongside new packets, rather than giving up.
+// A topic's pending packets are dropped after maxHistoryAttempts failures in a row, so one bad file can't hold the others back forever, and on shutdown.
+func drainHistory(q *historyQueue, w *history.Writer, sink *lineSink, lateAfter time.Duration) {
+	if lateAfter <= 0 {
+		lateAfter = defaultHistoryLateAfter
+	}
+
+	var retry []history.Packet   // failed, oldest first
+	attempts := map[string]int{} // failures in a row, by topic
+	var failures int
+	backoff := minHistoryRetry
+
+	for {
+		var batch []history.Packet
+		if len(retry) == 0 {
+			batch = q.pop(maxHistoryBatch)
+			if batch == nil {
+				return
+			}
+		} else {
+			// woken early on close, to try once more before giving up
+			select {
+			case <-time.After(backoff):
+			case <-q.done:
+			}
+			batch, _ = q.popNow(maxHistoryBatch)
+		}
+
+		if sink != nil {
+			for _, p := range batch {
+				sink.add(p)
+			}
+		}
+		if w == nil {
+			historyBacklog.Add(int64(-len(batch)))
+			continue
+		}
+
+		var shutdown bool
+		select {
+		case <-q.done:
+			shutdown = true
+		default:
+		}
+
+		pending := append(retry, batch...)
+		written, failed, err := w.WriteAll(pending)
+		retry = nil
+
+		now := time.Now()
+		for _, p := range written {
+			delete(attempts, p.Topic)
+			metricHistoryWritten.add(1, p.Topic)
+			if now.Sub(time.Unix(p.When, 0)) > lateAfter {
+				metricHistoryLate.add(1, p.Topic)
+			}
+		}
+		historyBacklog.Add(int64(len(failed) - len(pending))) // includes those skipped as they can't be encoded
+
+		if err == nil {
+			if failures != 0 {
+				logHistory.Info("history writes recovered", "failures", failures)
+				historyWriteErr.Store("")
+			}
+			failures = 0
+			backoff = minHistoryRetry
+			continue
+		}
+
+		failures++
+		metricHistoryWriteErrors.add(1)
+		historyWriteErr.Store(err.Error())
+		if failures == 1 {
+			logHistory.Error("could not write history, will retry", "pending", len(failed), "err", err)
+		}
+		backoff = min(backoff*2, maxHistoryRetry)
+
+		seen := map[string]bool{}
+		for _, p := range failed {
+			if !seen[p.Topic] {
+				seen[p.Topic] = true
+				attempts[p.Topic]++
+			}
+		}
+
+		var dropped int
+		for _, p := range failed {
+			if !shutdown && attempts[p.Topic] < maxHistoryAttempts {
+				retry = append(retry, p)
+				continue
+			}
+			metricHistoryDropped.add(1, p.Topic, "failed")
+			historyBacklog.Add(-1)
+			dropped++
+		}
+		if dropped != 0 {
+			logHistory.Error("could not write history, dropping", "dropped", dropped, "shutdown", shutdown, "err", err)
+		}
+		for topic, n := range attempts {
+			if n >= maxHistoryAttempts {
+				delete(attempts, topic) // start again with new packets
+			}
+		}
+	}
+}
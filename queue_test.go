@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samthor/gohaus/history"
+)
+
+func TestHistoryQueueDrop(t *testing.T) {
+	tests := []struct {
+		policy      historyDropPolicy
+		want        []int64
+		wantDropped int
+	}{
+		{"", []int64{2, 3, 4}, 2},
+		{dropOldest, []int64{2, 3, 4}, 2},
+		{dropNewest, []int64{0, 1, 2}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			topic := "test/drop/" + string(tt.policy)
+			before := droppedCount(topic, "overflow")
+			q := newHistoryQueue(3, tt.policy)
+			for i := range int64(5) {
+				q.push(history.Packet{Topic: topic, When: i})
+			}
+			q.close()
+			q.push(history.Packet{Topic: topic, When: 100}) // ignored
+
+			var got []int64
+			for _, p := range q.pop(2) {
+				got = append(got, p.When)
+			}
+			for _, p := range q.pop(10) {
+				got = append(got, p.When)
+			}
+			if q.pop(10) != nil {
+				t.Errorf("expected nil after close")
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if dropped := droppedCount(topic, "overflow") - before; dropped != float64(tt.wantDropped) {
+				t.Errorf("got %v dropped, want %d", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestDrainHistoryFailedTopic(t *testing.T) {
+	dir := t.TempDir()
+	w, err := history.NewWriter(history.WriterOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file where the topic's directory should be, so it can't be written
+	err = os.WriteFile(filepath.Join(dir, "drain_bad"), nil, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { historyWriteErr.Store("") }) // don't fail readiness in other tests
+
+	backlog := historyBacklog.Load()
+	before := droppedCount("drain/bad", "failed")
+	q := newHistoryQueue(10, dropOldest)
+	now := time.Now().Unix()
+	for _, topic := range []string{"drain/good", "drain/bad", "drain/good"} {
+		q.push(history.Packet{Topic: topic, When: now, Packet: map[string]any{"a": 1.0}})
+	}
+	q.close()
+
+	// closed, so failed packets are dropped rather than retried
+	drainHistory(q, w, nil, 0)
+	w.Close()
+
+	got, err := history.ReadFile(filepath.Join(dir, "drain_good", time.Unix(now, 0).UTC().Format("2006-01-02")+".jsonl"))
+	if err != nil || len(got) != 2 {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	if dropped := droppedCount("drain/bad", "failed") - before; dropped != 1 {
+		t.Errorf("got %v dropped, want 1", dropped)
+	}
+	if got := historyBacklog.Load(); got != backlog {
+		t.Errorf("got backlog %d, want %d", got, backlog)
+	}
+}
+
+func droppedCount(topic, reason string) float64 {
+	m := metricHistoryDropped
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s := m.series[labelKey([]string{topic, reason})]; s != nil {
+		return s.value
+	}
+	return 0
+}
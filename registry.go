@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	maxSetBody = 64 * 1024
+)
+
+// registry tracks running things by topic, so they can be seen from outside MQTT.
+type registry[T any] struct {
+	lock sync.RWMutex
+	m    map[string]*T
+}
+
+// add adds v to the registry, returning a func to remove it.
+func (r *registry[T]) add(topic string, v *T) (remove func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.m == nil {
+		r.m = map[string]*T{}
+	}
+	r.m[topic] = v
+
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		// a restarted instance may have already replaced this one
+		if r.m[topic] == v {
+			delete(r.m, topic)
+		}
+	}
+}
+
+func (r *registry[T]) get(topic string) *T {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.m[topic]
+}
+
+// all returns everything in the registry, sorted by topic.
+func (r *registry[T]) all() (out []*T) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, topic := range slices.Sorted(maps.Keys(r.m)) {
+		out = append(out, r.m[topic])
+	}
+	return out
+}
+
+var (
+	deviceRegistry  registry[registeredDevice]
+	historyRegistry registry[registeredHistory]
+)
+
+// registeredDevice is a running device created by Register.
+type registeredDevice struct {
+	topic      string
+	state      *deviceState
+	started    time.Time
+	staleAfter time.Duration
+
+	// submit sends a "/set" through the device's runner, as if it arrived via MQTT, and waits for its result.
+	// It returns false if ctx or the device is done first.
+	submit func(ctx context.Context, payload []byte) (result setResult, ok bool)
+}
+
+// registeredHistory is a running History.
+type registeredHistory struct {
+	topic      string
+	started    time.Time
+	staleAfter time.Duration
+
+	lock sync.Mutex
+	last time.Time // when a packet was last received
+}
+
+func (rh *registeredHistory) received(at time.Time) {
+	rh.lock.Lock()
+	defer rh.lock.Unlock()
+	rh.last = at
+}
+
+func (rh *registeredHistory) lastReceived() time.Time {
+	rh.lock.Lock()
+	defer rh.lock.Unlock()
+	return rh.last
+}
+
+type deviceInfo struct {
+	Topic     string    `json:"topic"`
+	At        time.Time `json:"at,omitzero"` // when state was last announced, zero if never
+	Recovered bool      `json:"recovered,omitempty"`
+}
+
+// handleDevices handles `GET /devices`, listing every registered device.
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	out := []deviceInfo{}
+	for _, rd := range deviceRegistry.all() {
+		_, at, recovered := rd.state.get()
+		out = append(out, deviceInfo{Topic: rd.topic, At: at, Recovered: recovered})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleDeviceGet handles `GET /devices/{topic...}`, returning the device's last announced state.
+func handleDeviceGet(w http.ResponseWriter, r *http.Request) {
+	rd := deviceRegistry.get(r.PathValue("topic"))
+	if rd == nil {
+		http.Error(w, "no such device", http.StatusNotFound)
+		return
+	}
+
+	payload, at, _ := rd.state.get()
+	if payload == nil {
+		http.Error(w, "no state yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", at.UTC().Format(http.TimeFormat))
+	w.Write(payload)
+}
+
+// handleDevicePost handles `POST /devices/{topic...}`, whose body is a Set for the device.
+// The body must be sent as application/json. This waits for the set to be applied, and responds with its setResult.
+func handleDevicePost(w http.ResponseWriter, r *http.Request) {
+	rd := deviceRegistry.get(r.PathValue("topic"))
+	if rd == nil {
+		http.Error(w, "no such device", http.StatusNotFound)
+		return
+	}
+
+	// the API has no auth, so require a type which a cross-origin page can't send without a preflight
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSetBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(payload) == 0 {
+		http.Error(w, "missing set", http.StatusBadRequest)
+		return
+	}
+
+	result, ok := rd.submit(r.Context(), payload)
+	if !ok {
+		http.Error(w, "device stopped", http.StatusServiceUnavailable)
+		return
+	}
+
+	status := http.StatusOK
+	if result.invalid {
+		status = http.StatusBadRequest
+	} else if !result.Success {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
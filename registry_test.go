@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testRegister registers a fake device for the duration of the test.
+func testRegister(t *testing.T, topic string, state string, submit func(ctx context.Context, payload []byte) (setResult, bool)) {
+	rd := &registeredDevice{topic: topic, state: &deviceState{}, submit: submit}
+	if state != "" {
+		rd.state.update([]byte(state))
+	}
+	t.Cleanup(deviceRegistry.add(topic, rd))
+}
+
+func TestHandleDevices(t *testing.T) {
+	testRegister(t, "virt/b", "", nil)
+	testRegister(t, "virt/a", `{"on":true}`, nil)
+
+	w := httptest.NewRecorder()
+	handleDevices(w, httptest.NewRequest("GET", "/devices", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status=%d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	a, b := strings.Index(body, `"topic":"virt/a","at":`), strings.Index(body, `{"topic":"virt/b"}`)
+	if a == -1 || b == -1 || a > b {
+		t.Errorf("devices=%s, want virt/a with state then virt/b without", body)
+	}
+}
+
+func TestHandleDeviceGet(t *testing.T) {
+	testRegister(t, "virt/empty", "", nil)
+	testRegister(t, "virt/full", `{"on":true}`, nil)
+
+	tests := []struct {
+		topic  string
+		status int
+		body   string
+	}{
+		{"virt/missing", http.StatusNotFound, ""},
+		{"virt/empty", http.StatusServiceUnavailable, ""},
+		{"virt/full", http.StatusOK, `{"on":true}`},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/devices/"+tt.topic, nil)
+		r.SetPathValue("topic", tt.topic)
+		w := httptest.NewRecorder()
+		handleDeviceGet(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("topic=%s status=%d, want %d", tt.topic, w.Code, tt.status)
+		} else if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("topic=%s body=%s, want %s", tt.topic, w.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestHandleDevicePost(t *testing.T) {
+	testRegister(t, "virt/dev", "", func(ctx context.Context, payload []byte) (setResult, bool) {
+		switch string(payload) {
+		case `{"ok":true}`:
+			return setResult{Success: true}, true
+		case `{"invalid":true}`:
+			return setResult{Error: "invalid set: bad", invalid: true}, true
+		case `{"stop":true}`:
+			return setResult{}, false
+		}
+		return setResult{Error: "device failed"}, true
+	})
+
+	tests := []struct {
+		name        string
+		topic       string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"missing", "virt/missing", "application/json", `{"ok":true}`, http.StatusNotFound},
+		{"no type", "virt/dev", "", `{"ok":true}`, http.StatusUnsupportedMediaType},
+		{"form", "virt/dev", "application/x-www-form-urlencoded", `{"ok":true}`, http.StatusUnsupportedMediaType},
+		{"empty", "virt/dev", "application/json", ``, http.StatusBadRequest},
+		{"success", "virt/dev", "application/json; charset=utf-8", `{"ok":true}`, http.StatusOK},
+		{"invalid", "virt/dev", "application/json", `{"invalid":true}`, http.StatusBadRequest},
+		{"error", "virt/dev", "application/json", `{"fail":true}`, http.StatusBadGateway},
+		{"stopped", "virt/dev", "application/json", `{"stop":true}`, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/devices/"+tt.topic, strings.NewReader(tt.body))
+		r.SetPathValue("topic", tt.topic)
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		handleDevicePost(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status=%d, want %d (%s)", tt.name, w.Code, tt.status, strings.TrimSpace(w.Body.String()))
+		}
+	}
+}
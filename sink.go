@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/samthor/gohaus/history"
+)
+
+const (
+	lineSinkFlushEvery = time.Second * 5
+	maxLineSinkBuffer  = 4 * 1024 * 1024
+)
+
+// lineSink sends history in InfluxDB line protocol to a file or HTTP endpoint.
+// Packets are buffered and sent regularly, so a slow or failing endpoint never blocks history.
+// If the endpoint fails, the buffer is kept and retried until it is full, after which packets are dropped.
+type lineSink struct {
+	cfg    LineSinkConfig
+	file   *os.File
+	client *http.Client
+
+	lock sync.Mutex
+	buf  []byte
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newLineSink(cfg LineSinkConfig) (*lineSink, error) {
+	if cfg.Measurement == "" {
+		cfg.Measurement = "gohaus"
+	}
+	s := &lineSink{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: defaultTimeout},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+		if err != nil {
+			return nil, err
+		}
+		s.file = f
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func (s *lineSink) add(p history.Packet) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.buf) >= maxLineSinkBuffer {
+		metricLineSinkDropped.add(1)
+		return
+	}
+	s.buf = history.AppendLine(s.buf, s.cfg.Measurement, p)
+}
+
+func (s *lineSink) run() {
+	defer close(s.stopped)
+
+	t := time.NewTicker(lineSinkFlushEvery)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.flush()
+		}
+	}
+}
+
+// flush sends everything buffered, putting it back on failure.
+func (s *lineSink) flush() {
+	s.lock.Lock()
+	b := s.buf
+	s.buf = nil
+	s.lock.Unlock()
+
+	if len(b) == 0 {
+		return
+	}
+
+	err := s.send(b)
+	if err == nil {
+		return
+	}
+	logHistory.Warn("could not send to line sink, will retry", "bytes", len(b), "err", err)
+	metricLineSinkErrors.add(1)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.buf = append(b, s.buf...)
+}
+
+func (s *lineSink) send(b []byte) error {
+	if s.file != nil {
+		_, err := s.file.Write(b)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("got %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// close sends anything still buffered, once.
+func (s *lineSink) close() error {
+	close(s.done)
+	<-s.stopped
+
+	s.flush()
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
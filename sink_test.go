@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/samthor/gohaus/history"
+)
+
+func TestLineSinkFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.lp")
+	s, err := newLineSink(LineSinkConfig{File: path})
+	if err != nil {
+		t.Fatalf("could not create sink: %v", err)
+	}
+
+	s.add(history.Packet{Topic: "a", When: 1, Packet: map[string]any{"x": 1.0}})
+	s.flush()
+	s.add(history.Packet{Topic: "b", When: 2, Packet: map[string]any{"x": 2.0}})
+	if err := s.close(); err != nil {
+		t.Fatalf("could not close: %v", err)
+	}
+
+	b, _ := os.ReadFile(path)
+	want := "gohaus,topic=a x=1 1000000000\ngohaus,topic=b x=2 2000000000\n"
+	if string(b) != want {
+		t.Errorf("file=%q, want %q", b, want)
+	}
+}
+
+func TestLineSinkRetry(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	var got strings.Builder
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("authorization=%q", r.Header.Get("Authorization"))
+		}
+		if fail.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		io.Copy(&got, r.Body)
+	}))
+	defer srv.Close()
+
+	s, err := newLineSink(LineSinkConfig{URL: srv.URL, Token: "secret", Measurement: "m"})
+	if err != nil {
+		t.Fatalf("could not create sink: %v", err)
+	}
+	defer s.close()
+
+	s.add(history.Packet{Topic: "a", When: 1, Packet: map[string]any{"x": 1.0}})
+	s.flush()
+	s.add(history.Packet{Topic: "a", When: 2, Packet: map[string]any{"x": 2.0}})
+
+	// the failed send is kept, and sent before anything newer
+	fail.Store(false)
+	s.flush()
+	want := "m,topic=a x=1 1000000000\nm,topic=a x=2 2000000000\n"
+	if got.String() != want {
+		t.Errorf("sent=%q, want %q", got.String(), want)
+	}
+}
+
+func TestLineSinkFull(t *testing.T) {
+	s := &lineSink{cfg: LineSinkConfig{Measurement: "m"}, buf: make([]byte, maxLineSinkBuffer)}
+	s.add(history.Packet{Topic: "a", When: 1, Packet: map[string]any{"x": 1.0}})
+	if len(s.buf) != maxLineSinkBuffer {
+		t.Errorf("packet added to full buffer, len=%d", len(s.buf))
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/samthor/gohaus/history"
+)
+
+const (
+	wsBuffer       = 64
+	wsWriteTimeout = time.Second * 10
+	wsPingEvery    = time.Second * 30
+)
+
+// event is streamed to WebSocket clients.
+type event struct {
+	Type  string    `json:"type"` // "state", "history" or "error"
+	Topic string    `json:"topic,omitempty"`
+	At    time.Time `json:"at"`
+	Data  any       `json:"data"`
+}
+
+// wsRequest is sent by WebSocket clients to change the topics they receive events for.
+type wsRequest struct {
+	Topics []string `json:"topics"`
+}
+
+type wsClient struct {
+	ch       chan []byte
+	patterns []string // guarded by eventHub.lock
+}
+
+// eventHub fans out events to WebSocket clients.
+type eventHub struct {
+	lock    sync.Mutex
+	clients map[*wsClient]bool
+}
+
+var hub = &eventHub{clients: map[*wsClient]bool{}}
+
+func (h *eventHub) matches(c *wsClient, topic string) bool {
+	for _, pattern := range c.patterns {
+		if history.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast sends the event to every client interested in its topic.
+// Clients which can't keep up are disconnected.
+func (h *eventHub) broadcast(ev event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var b []byte
+	for c := range h.clients {
+		if !h.matches(c, ev.Topic) {
+			continue
+		}
+		if b == nil {
+			var err error
+			b, err = json.Marshal(ev)
+			if err != nil {
+				logHTTP.Error("couldn't JSON-encode event", "topic", ev.Topic, "err", err)
+				return
+			}
+		}
+		h.send(c, b)
+	}
+}
+
+// send queues the encoded event for c, dropping c if it's too slow.
+// Must be called with lock held.
+func (h *eventHub) send(c *wsClient, b []byte) {
+	if !h.clients[c] {
+		return // already removed, c.ch is closed
+	}
+	select {
+	case c.ch <- b:
+	default:
+		logHTTP.Warn("dropping slow websocket client")
+		h.removeLocked(c)
+	}
+}
+
+// add adds a client for the given patterns, queueing the current state of matching devices.
+func (h *eventHub) add(patterns []string) *wsClient {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	c := &wsClient{ch: make(chan []byte, wsBuffer), patterns: patterns}
+	h.clients[c] = true
+	h.snapshotLocked(c)
+	return c
+}
+
+// setPatterns replaces the patterns for c, queueing the current state of newly matching devices.
+func (h *eventHub) setPatterns(c *wsClient, patterns []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.clients[c] {
+		return
+	}
+	c.patterns = patterns
+	h.snapshotLocked(c)
+}
+
+func (h *eventHub) snapshotLocked(c *wsClient) {
+	for _, rd := range deviceRegistry.all() {
+		if !h.matches(c, rd.topic) {
+			continue
+		}
+		payload, at, _ := rd.state.get()
+		if payload == nil {
+			continue
+		}
+		b, _ := json.Marshal(event{Type: "state", Topic: rd.topic, At: at, Data: payload})
+		h.send(c, b)
+	}
+}
+
+func (h *eventHub) remove(c *wsClient) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.removeLocked(c)
+}
+
+func (h *eventHub) removeLocked(c *wsClient) {
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.ch)
+	}
+}
+
+// wsUpgrader uses the default origin check, allowing clients without an Origin (i.e., not browsers) or served from this host.
+// The API has no auth, so this stops any page open on the local network from reading state.
+var wsUpgrader = websocket.Upgrader{}
+
+// validTopicPatterns returns an error if any pattern isn't a valid MQTT topic filter.
+func validTopicPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if !history.ValidTopicFilter(pattern) {
+			return fmt.Errorf("invalid topic pattern: %q", pattern)
+		}
+	}
+	return nil
+}
+
+// wsHandler handles `GET /ws`, streaming state and history events as JSON to WebSocket clients.
+// Clients receive events for topics matching the MQTT-style patterns in "?topic=" (default "#"), and may replace them by sending a wsRequest.
+// Connections are closed when ctx is done.
+func wsHandler(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		patterns := r.URL.Query()["topic"]
+		if len(patterns) == 0 {
+			patterns = []string{"#"}
+		}
+		if err := validTopicPatterns(patterns); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // already responded
+		}
+		defer conn.Close()
+
+		c := hub.add(patterns)
+		defer hub.remove(c)
+
+		// read requests until the client goes away
+		readDone := make(chan struct{})
+		go func() {
+			defer close(readDone)
+			for {
+				var req wsRequest
+				err := conn.ReadJSON(&req)
+				if err != nil {
+					return
+				}
+
+				err = validTopicPatterns(req.Topics)
+				if err != nil {
+					b, _ := json.Marshal(event{Type: "error", At: time.Now(), Data: err.Error()})
+					hub.lock.Lock()
+					hub.send(c, b)
+					hub.lock.Unlock()
+					continue
+				}
+				hub.setPatterns(c, req.Topics)
+			}
+		}()
+
+		t := time.NewTicker(wsPingEvery)
+		defer t.Stop()
+
+		for {
+			var msgType int
+			var b []byte
+
+			select {
+			case <-ctx.Done():
+				msgType = websocket.CloseMessage
+				b = websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down")
+			case <-readDone:
+				return
+			case <-t.C:
+				msgType = websocket.PingMessage
+			case msg, ok := <-c.ch:
+				if !ok {
+					msgType = websocket.CloseMessage
+					b = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow")
+				} else {
+					msgType = websocket.TextMessage
+					b = msg
+				}
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err := conn.WriteMessage(msgType, b)
+			if err != nil || msgType == websocket.CloseMessage {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestHub() *eventHub {
+	return &eventHub{clients: map[*wsClient]bool{}}
+}
+
+// drain reads every queued event for c, returning false if c.ch was closed.
+func drain(c *wsClient) (events []event, open bool) {
+	for {
+		select {
+		case b, ok := <-c.ch:
+			if !ok {
+				return events, false
+			}
+			var ev event
+			json.Unmarshal(b, &ev)
+			events = append(events, ev)
+		default:
+			return events, true
+		}
+	}
+}
+
+func TestEventHubMatch(t *testing.T) {
+	h := newTestHub()
+	a := h.add([]string{"virt/+/a"})
+	all := h.add([]string{"#"})
+
+	h.broadcast(event{Type: "state", Topic: "virt/x/a", At: time.Now()})
+	h.broadcast(event{Type: "state", Topic: "virt/x/b", At: time.Now()})
+
+	if events, _ := drain(a); len(events) != 1 || events[0].Topic != "virt/x/a" {
+		t.Errorf("a got %+v, want only virt/x/a", events)
+	}
+	if events, _ := drain(all); len(events) != 2 {
+		t.Errorf("all got %+v, want both", events)
+	}
+}
+
+func TestEventHubSlowClient(t *testing.T) {
+	h := newTestHub()
+	slow := h.add([]string{"#"})
+
+	for range wsBuffer + 1 {
+		h.broadcast(event{Type: "state", Topic: "virt/x", At: time.Now()})
+	}
+	if events, open := drain(slow); open || len(events) != wsBuffer {
+		t.Fatalf("slow client got %d events open=%v, want %d and closed", len(events), open, wsBuffer)
+	}
+
+	// the client's reader may still try to send to it, e.g., an error for a bad request
+	b, _ := json.Marshal(event{Type: "error", At: time.Now()})
+	h.lock.Lock()
+	h.send(slow, b)
+	h.lock.Unlock()
+	h.setPatterns(slow, []string{"#"})
+	h.remove(slow)
+}
+
+func TestEventHubDisconnectDuringBroadcast(t *testing.T) {
+	h := newTestHub()
+	stay := h.add([]string{"virt/stay"})
+
+	const count = 200
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for range count {
+			h.broadcast(event{Type: "state", Topic: "virt/x", At: time.Now()})
+		}
+	}()
+
+	// clients come and go while broadcasts are in flight, and may be dropped as slow before they disconnect
+	go func() {
+		defer wg.Done()
+		for range count {
+			c := h.add([]string{"#"})
+			b, _ := json.Marshal(event{Type: "error", At: time.Now()})
+			h.lock.Lock()
+			h.send(c, b)
+			h.lock.Unlock()
+			h.remove(c)
+			h.lock.Lock()
+			h.send(c, b)
+			h.lock.Unlock()
+		}
+	}()
+	wg.Wait()
+
+	h.broadcast(event{Type: "state", Topic: "virt/stay", At: time.Now()})
+	if events, open := drain(stay); !open || len(events) != 1 {
+		t.Errorf("remaining client got %d events open=%v, want 1 and open", len(events), open)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.clients) != 1 {
+		t.Errorf("hub has %d clients, want 1", len(h.clients))
+	}
+}